@@ -0,0 +1,169 @@
+// Package config holds the typed configuration of the API and the email
+// worker. Values come, in increasing order of precedence, from the defaults
+// declared in the struct tags, an optional YAML file, the environment and
+// command-line flags.
+//
+// Field tags:
+//
+//	yaml:"name"        key in the YAML file; also the flag name, joined with
+//	                   dots for nested sections (-postgres.host)
+//	env:"NAME"         environment variable
+//	default:"value"    value used when no source sets the field
+//	secret:"true"      printed as [REDACTED]
+//	validate:"rule"    required, port, positive or oneof=a b c
+package config
+
+import "time"
+
+// API configures the HTTP API, the ingestion loop and their dependencies.
+type API struct {
+	// Storage selects the backends: "postgres" uses Postgres, ClickHouse and
+	// RabbitMQ, "memory" keeps everything in the process and ignores their
+	// sections.
+	Storage     string      `yaml:"storage" env:"STORAGE" default:"postgres" validate:"oneof=postgres memory"`
+	HTTP        HTTP        `yaml:"http"`
+	Postgres    Postgres    `yaml:"postgres"`
+	ClickHouse  ClickHouse  `yaml:"clickhouse"`
+	OpenWeather OpenWeather `yaml:"openweather"`
+	Ingestion   Ingestion   `yaml:"ingestion"`
+	Outbox      Outbox      `yaml:"outbox"`
+	RabbitMQ    RabbitMQ    `yaml:"rabbitmq"`
+	Logging     Logging     `yaml:"logging"`
+	Tracing     Tracing     `yaml:"tracing"`
+}
+
+// Unused reports the sections the selected storage does not need.
+func (a *API) Unused(section string) bool {
+	if a.Storage != "memory" {
+		return false
+	}
+	switch section {
+	case "postgres", "clickhouse", "rabbitmq":
+		return true
+	}
+	return false
+}
+
+// Worker configures smtp_service.
+type Worker struct {
+	RabbitMQ RabbitMQ `yaml:"rabbitmq"`
+	// Transport selects how emails leave the worker: "smtp" sends them,
+	// "maildir" writes them to MailDir and "stdout" prints them. Only smtp
+	// needs the smtp section.
+	Transport  string        `yaml:"transport" env:"MAIL_TRANSPORT" default:"smtp" validate:"oneof=smtp maildir stdout"`
+	MailDir    string        `yaml:"maildir" env:"MAIL_DIR" default:"maildir"`
+	SMTP       SMTP          `yaml:"smtp"`
+	Retry      Retry         `yaml:"retry"`
+	Dedup      Dedup         `yaml:"dedup"`
+	Workers    int           `yaml:"workers" env:"WORKERS" default:"3" validate:"positive"`
+	Prefetch   int           `yaml:"prefetch" env:"PREFETCH" default:"5" validate:"positive"`
+	HealthAddr string        `yaml:"health_addr" env:"HEALTH_ADDR" default:":8081" validate:"required"`
+	Shutdown   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"5s" validate:"positive"`
+	Logging    Logging       `yaml:"logging"`
+	Tracing    Tracing       `yaml:"tracing"`
+}
+
+// DeadLetters configures `smtp_service dlq`, which lists or replays the
+// emails in the dead-letter queue. Limit 0 means all of them.
+type DeadLetters struct {
+	RabbitMQ RabbitMQ `yaml:"rabbitmq"`
+	Limit    int      `yaml:"limit" env:"DLQ_LIMIT" default:"0"`
+	Logging  Logging  `yaml:"logging"`
+}
+
+// Unused reports the sections the selected transport does not need.
+func (w *Worker) Unused(section string) bool {
+	return section == "smtp" && w.Transport != "smtp"
+}
+
+type HTTP struct {
+	Port            int           `yaml:"port" env:"HTTP_PORT" default:"8080" validate:"port"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"30s" validate:"positive"`
+}
+
+type Postgres struct {
+	Host     string `yaml:"host" env:"POSTGRES_HOST" validate:"required"`
+	Port     int    `yaml:"port" env:"POSTGRES_PORT" default:"5432" validate:"port"`
+	User     string `yaml:"user" env:"POSTGRES_USER" validate:"required"`
+	Password string `yaml:"password" env:"POSTGRES_PASSWORD" secret:"true"`
+	DB       string `yaml:"db" env:"POSTGRES_DB" validate:"required"`
+}
+
+type ClickHouse struct {
+	Host     string `yaml:"host" env:"CLICKHOUSE_HOST" validate:"required"`
+	Port     int    `yaml:"port" env:"CLICKHOUSE_PORT" default:"9000" validate:"port"`
+	User     string `yaml:"user" env:"CLICKHOUSE_USER" validate:"required"`
+	Password string `yaml:"password" env:"CLICKHOUSE_PASSWORD" secret:"true" validate:"required"`
+	DB       string `yaml:"db" env:"CLICKHOUSE_DB" validate:"required"`
+	// Timeout bounds table creation and each batch insert.
+	Timeout time.Duration `yaml:"timeout" env:"CLICKHOUSE_TIMEOUT" default:"5s" validate:"positive"`
+}
+
+type OpenWeather struct {
+	APIKey       string `yaml:"api_key" env:"API_WEATHER_KEY" secret:"true" validate:"required"`
+	WeatherURL   string `yaml:"weather_url" env:"OPENWEATHER_WEATHER_URL" default:"https://pro.openweathermap.org/data/2.5/weather" validate:"required"`
+	GeocodingURL string `yaml:"geocoding_url" env:"OPENWEATHER_GEOCODING_URL" default:"http://api.openweathermap.org/geo/1.0/direct" validate:"required"`
+}
+
+type Ingestion struct {
+	Interval time.Duration `yaml:"interval" env:"INGESTION_INTERVAL" default:"30s" validate:"positive"`
+}
+
+// Outbox configures the relay publishing queued emails to RabbitMQ.
+type Outbox struct {
+	Interval time.Duration `yaml:"interval" env:"OUTBOX_INTERVAL" default:"5s" validate:"positive"`
+	Batch    int           `yaml:"batch" env:"OUTBOX_BATCH" default:"100" validate:"positive"`
+}
+
+type RabbitMQ struct {
+	// URL carries the credentials, so it is never printed.
+	URL string `yaml:"url" env:"RABBITMQ_URL" secret:"true" validate:"required"`
+}
+
+// SMTP configures the sender and the smtp transport of smtp_service. TLS is
+// "starttls" (upgrade after connecting, usually port 587), "tls" (implicit
+// TLS, usually 465) or "none". DomainRate limits the emails a minute to each
+// recipient domain, after bursts of DomainBurst; 0 disables the limit.
+type SMTP struct {
+	Host        string        `yaml:"host" env:"SMTP_HOST" validate:"required"`
+	Port        int           `yaml:"port" env:"SMTP_PORT" default:"587" validate:"port"`
+	User        string        `yaml:"user" env:"SMTP_USER"`
+	Password    string        `yaml:"password" env:"SMTP_PASSWORD" secret:"true"`
+	TLS         string        `yaml:"tls" env:"SMTP_TLS" default:"starttls" validate:"oneof=starttls tls none"`
+	From        string        `yaml:"from" env:"SMTP_FROM" validate:"required"`
+	SendTimeout time.Duration `yaml:"send_timeout" env:"SMTP_SEND_TIMEOUT" default:"15s" validate:"positive"`
+	DomainRate  int           `yaml:"domain_rate" env:"SMTP_DOMAIN_RATE" default:"60"`
+	DomainBurst int           `yaml:"domain_burst" env:"SMTP_DOMAIN_BURST" default:"10" validate:"positive"`
+}
+
+// Retry bounds the redelivery of emails that failed to send. Attempt n is
+// retried after Backoff*2^(n-1); after MaxAttempts the email goes to the
+// dead-letter queue.
+type Retry struct {
+	MaxAttempts int           `yaml:"max_attempts" env:"RETRY_MAX_ATTEMPTS" default:"5" validate:"positive"`
+	Backoff     time.Duration `yaml:"backoff" env:"RETRY_BACKOFF" default:"30s" validate:"positive"`
+}
+
+// Dedup keeps the keys of delivered emails in File for TTL, so that an email
+// redelivered by RabbitMQ after it was sent is not sent again.
+type Dedup struct {
+	File string        `yaml:"file" env:"DEDUP_FILE" default:"delivered.log" validate:"required"`
+	TTL  time.Duration `yaml:"ttl" env:"DEDUP_TTL" default:"24h" validate:"positive"`
+}
+
+type Logging struct {
+	Format string `yaml:"format" env:"LOG_FORMAT" default:"text" validate:"oneof=text json"`
+	Level  string `yaml:"level" env:"LOG_LEVEL" default:"info" validate:"oneof=debug info warn error"`
+}
+
+type Tracing struct {
+	Exporter string `yaml:"exporter" env:"TRACES_EXPORTER" default:"none" validate:"oneof=none stdout file"`
+	File     string `yaml:"file" env:"TRACES_FILE"`
+}
+
+func (t Tracing) Validate() error {
+	if t.Exporter == "file" && t.File == "" {
+		return errFileRequired
+	}
+	return nil
+}
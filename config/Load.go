@@ -0,0 +1,278 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[REDACTED]"
+
+var errFileRequired = errors.New(`file is required when exporter is "file"`)
+
+// validator is implemented by sections with rules spanning several fields.
+type validator interface {
+	Validate() error
+}
+
+// sectionFilter is implemented by configs with sections that may be unused
+// depending on other fields; unused sections are not validated.
+type sectionFilter interface {
+	Unused(section string) bool
+}
+
+type field struct {
+	path   string
+	env    string
+	def    string
+	secret bool
+	rule   string
+	value  reflect.Value
+}
+
+func (f field) String() string {
+	if f.env != "" {
+		return f.path + " (" + f.env + ")"
+	}
+	return f.path
+}
+
+// Load fills cfg, a pointer to API, Worker or DeadLetters. args are the
+// command-line arguments without the program name; -config, or CONFIG_FILE,
+// names the YAML file. Every invalid field is reported, not just the first
+// one.
+func Load(cfg any, name string, args []string) error {
+	root := reflect.ValueOf(cfg).Elem()
+	fields, validators := collect(root, "")
+
+	type flagValue struct {
+		f     field
+		value string
+	}
+	var fromFlags []flagValue
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	for _, f := range fields {
+		f := f
+		usage := "env " + f.env
+		if f.def != "" {
+			usage += ", default " + f.def
+		}
+		fs.Func(f.path, usage, func(s string) error {
+			fromFlags = append(fromFlags, flagValue{f, s})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, f := range fields {
+		if f.def == "" {
+			continue
+		}
+		if err := set(f.value, f.def); err != nil {
+			errs = append(errs, fmt.Errorf("%s: default: %w", f, err))
+		}
+	}
+
+	if *path != "" {
+		if err := loadFile(*path, cfg); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+
+	for _, f := range fields {
+		s, ok := os.LookupEnv(f.env)
+		if f.env == "" || !ok {
+			continue
+		}
+		if err := set(f.value, s); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+		}
+	}
+
+	for _, fv := range fromFlags {
+		if err := set(fv.f.value, fv.value); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", fv.f.path, err))
+		}
+	}
+
+	unused := func(path string) bool {
+		filter, ok := cfg.(sectionFilter)
+		section, _, _ := strings.Cut(path, ".")
+		return ok && filter.Unused(section)
+	}
+	for _, f := range fields {
+		if unused(f.path) {
+			continue
+		}
+		if err := check(f); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+		}
+	}
+	for path, v := range validators {
+		if unused(path) {
+			continue
+		}
+		if err := v.Interface().(validator).Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func loadFile(path string, cfg any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+var validatorType = reflect.TypeOf((*validator)(nil)).Elem()
+
+// collect lists the leaf fields of v and pointers to the sections that
+// validate themselves, keyed by their dotted path. v must be addressable, so
+// that Validate sees the values loaded after collect.
+func collect(v reflect.Value, prefix string) ([]field, map[string]reflect.Value) {
+	var fields []field
+	validators := make(map[string]reflect.Value)
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		path := prefix + key
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Duration(0)) {
+			if fv.Addr().Type().Implements(validatorType) {
+				validators[path] = fv.Addr()
+			}
+			nested, nestedValidators := collect(fv, path+".")
+			fields = append(fields, nested...)
+			for p, val := range nestedValidators {
+				validators[p] = val
+			}
+			continue
+		}
+
+		fields = append(fields, field{
+			path:   path,
+			env:    sf.Tag.Get("env"),
+			def:    sf.Tag.Get("default"),
+			secret: sf.Tag.Get("secret") == "true",
+			rule:   sf.Tag.Get("validate"),
+			value:  fv,
+		})
+	}
+	return fields, validators
+}
+
+func set(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("not an integer: %q", s)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %q", s)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func check(f field) error {
+	rule, arg, _ := strings.Cut(f.rule, "=")
+	switch rule {
+	case "":
+	case "required":
+		if f.value.IsZero() {
+			return errors.New("required")
+		}
+	case "port":
+		if n := f.value.Int(); n < 1 || n > 65535 {
+			return fmt.Errorf("port %d out of range", n)
+		}
+	case "positive":
+		if f.value.Int() <= 0 {
+			return errors.New("must be positive")
+		}
+	case "oneof":
+		allowed := strings.Fields(arg)
+		for _, a := range allowed {
+			if f.value.String() == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", f.value.String(), strings.Join(allowed, ", "))
+	default:
+		return fmt.Errorf("unknown rule %q", f.rule)
+	}
+	return nil
+}
+
+// LogValue renders cfg, a pointer to API or Worker, as nested log groups with
+// secrets redacted.
+func LogValue(cfg any) slog.Value {
+	return logValue(reflect.ValueOf(cfg).Elem())
+}
+
+func logValue(v reflect.Value) slog.Value {
+	t := v.Type()
+	attrs := make([]slog.Attr, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		fv := v.Field(i)
+
+		switch {
+		case sf.Tag.Get("secret") == "true":
+			shown := ""
+			if !fv.IsZero() {
+				shown = redacted
+			}
+			attrs = append(attrs, slog.String(key, shown))
+		case sf.Type == reflect.TypeOf(time.Duration(0)):
+			attrs = append(attrs, slog.String(key, time.Duration(fv.Int()).String()))
+		case fv.Kind() == reflect.Struct:
+			attrs = append(attrs, slog.Attr{Key: key, Value: logValue(fv)})
+		default:
+			attrs = append(attrs, slog.Any(key, fv.Interface()))
+		}
+	}
+	return slog.GroupValue(attrs...)
+}
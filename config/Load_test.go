@@ -0,0 +1,42 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadValidatesLoadedValues(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("TRACES_FILE", "")
+
+	var cfg Worker
+	err := Load(&cfg, "test", []string{"-tracing.exporter=file", "-transport=stdout", "-rabbitmq.url=amqp://localhost"})
+	if !errors.Is(err, errFileRequired) {
+		t.Fatalf("exporter file without a file: err = %v, want errFileRequired", err)
+	}
+
+	cfg = Worker{}
+	err = Load(&cfg, "test", []string{"-tracing.exporter=file", "-tracing.file=traces.json", "-transport=stdout", "-rabbitmq.url=amqp://localhost"})
+	if err != nil {
+		t.Fatalf("exporter file with a file: %v", err)
+	}
+}
+
+func TestLoadKeepsDefaultErrorsWhenFileFails(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	var cfg struct {
+		N int `yaml:"n" default:"many"`
+	}
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+
+	err := Load(&cfg, "test", []string{"-config", missing})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("err = %v, want the missing file reported", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "n: default") {
+		t.Errorf("err = %v, want the bad default reported too", err)
+	}
+}
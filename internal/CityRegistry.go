@@ -0,0 +1,123 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cityRegistry is a concurrency-safe set of known cities keyed by the name
+// users asked for. Reads never block on geocoding or on metrics store writes.
+type cityRegistry struct {
+	mu     sync.RWMutex
+	cities map[string]CityType
+
+	// addMu serializes Add so that the same city is never persisted twice
+	// by concurrent requests.
+	addMu sync.Mutex
+	group singleflight.Group
+}
+
+// NewCityRegistry returns an empty registry.
+func NewCityRegistry() CityRegistry {
+	return &cityRegistry{cities: make(map[string]CityType)}
+}
+
+func (r *cityRegistry) Get(name string) (CityType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	city, ok := r.cities[name]
+	return city, ok
+}
+
+func (r *cityRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.cities)
+}
+
+// Snapshot returns a copy of the registry that the caller may iterate freely.
+func (r *cityRegistry) Snapshot() map[string]CityType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	snapshot := make(map[string]CityType, len(r.cities))
+	for name, city := range r.cities {
+		snapshot[name] = city
+	}
+	return snapshot
+}
+
+// Resolve returns the cities from names that are not registered yet, geocoded
+// with geocode. Concurrent lookups of the same name share a single geocode call.
+// Nothing is registered; pass the result to Add for that.
+func (r *cityRegistry) Resolve(names []string, geocode func(string) (CityType, error)) (map[string]CityType, error) {
+	resolved := make(map[string]CityType)
+	for _, name := range names {
+		if _, ok := r.Get(name); ok {
+			continue
+		}
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+
+		v, err, _ := r.group.Do(name, func() (interface{}, error) {
+			return geocode(name)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("CityRegistry.Resolve: city %s: %w", name, err)
+		}
+		resolved[name] = v.(CityType)
+	}
+	return resolved, nil
+}
+
+// Add persists the cities that are still unknown with persist and registers
+// them once persist succeeds.
+func (r *cityRegistry) Add(ctx context.Context, cities map[string]CityType, persist func(context.Context, map[string]CityType) error) error {
+	r.addMu.Lock()
+	defer r.addMu.Unlock()
+
+	fresh := make(map[string]CityType, len(cities))
+	for name, city := range cities {
+		if _, ok := r.Get(name); !ok {
+			fresh[name] = city
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	if err := persist(ctx, fresh); err != nil {
+		return fmt.Errorf("CityRegistry.Add: %w", err)
+	}
+
+	r.mu.Lock()
+	for name, city := range fresh {
+		r.cities[name] = city
+	}
+	r.mu.Unlock()
+
+	slog.Info("CityRegistry.Add: registered cities", "count", len(fresh))
+	return nil
+}
+
+// Reload replaces the registry contents with the cities returned by load.
+func (r *cityRegistry) Reload(ctx context.Context, load func(context.Context) (map[string]CityType, error)) error {
+	r.addMu.Lock()
+	defer r.addMu.Unlock()
+
+	cities, err := load(ctx)
+	if err != nil {
+		return fmt.Errorf("CityRegistry.Reload: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cities = cities
+	r.mu.Unlock()
+
+	slog.Info("CityRegistry.Reload: loaded cities", "count", len(cities))
+	return nil
+}
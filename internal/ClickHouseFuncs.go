@@ -4,18 +4,13 @@ package weatherservice
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"net"
+	"strconv"
 	"time"
-	"sync"
 
 	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
-)
-
-var (
-	ClickhouseConn clickhouse.Conn
-	MapOfCities    map[string]CityType = make(map[string]CityType)
-	mapMu          sync.RWMutex
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
 )
 
 type CityType struct {
@@ -24,51 +19,46 @@ type CityType struct {
 	Lon  float32 `json:"lon"`
 }
 
-func InitClickhouse() error {
-	host := os.Getenv("CLICKHOUSE_HOST")
-	port := os.Getenv("CLICKHOUSE_PORT")
-	user := os.Getenv("CLICKHOUSE_USER")
-	password := os.Getenv("CLICKHOUSE_PASSWORD")
-	database := os.Getenv("CLICKHOUSE_DB")
-
-	log.Printf("InitClickhouse: env host=%s port=%s user=%s db=%s", host, port, user, database)
+// ClickHouseStore is the MetricsStore backed by ClickHouse.
+type ClickHouseStore struct {
+	conn clickhouse.Conn
 
-	if host == "" || port == "" || user == "" || password == "" || database == "" {
-		return fmt.Errorf("ClickHouse environment variables are not set properly")
-	}
+	// timeout bounds table creation and each batch insert.
+	timeout time.Duration
+}
 
+// NewClickHouseStore connects to ClickHouse and creates the tables.
+func NewClickHouseStore(cfg config.ClickHouse) (*ClickHouseStore, error) {
 	conn, err := clickhouse.Open(&clickhouse.Options{
-		Addr: []string{fmt.Sprintf("%s:%s", host, port)},
+		Addr: []string{net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))},
 		Auth: clickhouse.Auth{
-			Database: database,
-			Username: user,
-			Password: password,
+			Database: cfg.DB,
+			Username: cfg.User,
+			Password: cfg.Password,
 		},
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to connect to ClickHouse: %v", err)
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %v", err)
 	}
 
-	ClickhouseConn = conn
-
-	if err := createTables(); err != nil {
-		return fmt.Errorf("failed to create tables: %v", err)
+	store := &ClickHouseStore{conn: conn, timeout: cfg.Timeout}
+	if err := store.createTables(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create tables: %v", err)
 	}
 
-	startPeriodicTask(30)
-	log.Println("InitClickhouse: ready and periodic task started")
-
-	return nil
+	slog.Info("NewClickHouseStore: ready")
+	return store, nil
 }
 
-func createTables() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (c *ClickHouseStore) createTables() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 	defer cancel()
 
 	queries := []string{
-		`CREATE TABLE IF NOT EXISTS weather_metrics ( 
-                timestamp Datetime, 
+		`CREATE TABLE IF NOT EXISTS weather_metrics (
+                timestamp Datetime,
                 city String,
                 temp Float32,
                 app_temp Float32,
@@ -88,128 +78,111 @@ func createTables() error {
 	}
 
 	for _, query := range queries {
-		if err := ClickhouseConn.Exec(ctx, query); err != nil {
+		if err := c.conn.Exec(ctx, query); err != nil {
 			return fmt.Errorf("failed to create table: %v", err)
 		}
 	}
 
-	rows, err := ClickhouseConn.Query(ctx, "SELECT city, lat, lon FROM cities")
+	return nil
+}
+
+func (c *ClickHouseStore) LoadCities(ctx context.Context) (map[string]CityType, error) {
+	rows, err := c.conn.Query(ctx, "SELECT city, lat, lon FROM cities")
 	if err != nil {
-		return fmt.Errorf("initClickHouse: select cities: %w", err)
+		return nil, fmt.Errorf("LoadCities: select cities: %w", err)
 	}
 	defer rows.Close()
 
+	cities := make(map[string]CityType)
 	for rows.Next() {
 		var city string
 		var lat, lon float32
 
 		if err := rows.Scan(&city, &lat, &lon); err != nil {
-			log.Printf("initClickHouse: scan error: %v", err)
+			slog.Warn("LoadCities: scan error", "err", err)
 			continue
 		}
 
-		MapOfCities[city] = CityType{
+		cities[city] = CityType{
 			Name: city,
 			Lat:  lat,
 			Lon:  lon,
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("LoadCities: rows: %w", err)
+	}
 
-	log.Printf("initClickHouse: loaded %d cities from DB", len(MapOfCities))
-
-	return nil
+	return cities, nil
 }
 
-func addCitiesToDB(cities []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (c *ClickHouseStore) InsertCities(ctx context.Context, cities map[string]CityType) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 
-	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO cities (city, lat, lon)")
+	ctx, span := startClickhouseSpan(ctx, "INSERT cities")
+	defer func() { endSpan(span, err) }()
+
+	batch, err := c.conn.PrepareBatch(ctx, "INSERT INTO cities (city, lat, lon)")
 	if err != nil {
-		return fmt.Errorf("addCitiesToDB: prepare batch: %w", err)
+		return fmt.Errorf("InsertCities: prepare batch: %w", err)
 	}
 
-	tmpMapOfCities := make(map[string]CityType)
-
-	for _, cityName := range cities {
-		_, ok := MapOfCities[cityName]
-		if ok {
-			continue
-		}
-
-		city, err := GetCoordinates(cityName)
-		if err != nil {
-			return fmt.Errorf("addCitiesToDB: get coordinates for city %s: %w", cityName, err)
-		}
-		tmpMapOfCities[cityName] = city
-
-		if err := batch.Append(city.Name, city.Lat, city.Lon); err != nil {
-			return fmt.Errorf("addCitiesToDB: append to batch: %w", err)
+	for name, city := range cities {
+		if err := batch.Append(name, city.Lat, city.Lon); err != nil {
+			return fmt.Errorf("InsertCities: append to batch: %w", err)
 		}
 	}
 
+	clickhouseBatchSize.WithLabelValues("cities").Observe(float64(len(cities)))
 	if err := batch.Send(); err != nil {
-		return fmt.Errorf("addCitiesToDB: send batch: %w", err)
+		return fmt.Errorf("InsertCities: send batch: %w", err)
 	}
 
-	for k, v := range tmpMapOfCities {
-		MapOfCities[k] = v
-	}
-	log.Printf("addCitiesToDB: added %d cities to DB and map", len(tmpMapOfCities))
-
+	slog.InfoContext(ctx, "InsertCities: added cities to DB", "count", len(cities))
 	return nil
 }
 
-func insertWeatherData(cities map[string]CityType) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (c *ClickHouseStore) InsertWeather(ctx context.Context, samples []WeatherSample) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
-	
-	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO weather_metrics (timestamp, city, temp, app_temp, pressure, wind_speed, wind_deg)")
-	if err != nil {
-		return fmt.Errorf("insertWeatherResponses: prepare batch: %w", err)
-	}
 
-	for cityName, city := range cities {
-		weatherResp, err := GetWeather(city)
-		if err != nil {
-			return fmt.Errorf("insertWeatherResponses: get weather for city %s: %w", cityName, err)
-		}
+	ctx, span := startClickhouseSpan(ctx, "INSERT weather_metrics")
+	defer func() { endSpan(span, err) }()
 
-		t := time.Unix(weatherResp.Dt, 0)
+	batch, err := c.conn.PrepareBatch(ctx, "INSERT INTO weather_metrics (timestamp, city, temp, app_temp, pressure, wind_speed, wind_deg)")
+	if err != nil {
+		return fmt.Errorf("InsertWeather: prepare batch: %w", err)
+	}
 
+	for _, sample := range samples {
 		if err := batch.Append(
-			t,
-			cityName,
-			weatherResp.Main.Temp,
-			weatherResp.Main.FeelsLike,
-			weatherResp.Main.Pressure,
-			weatherResp.Wind.Speed,
-			weatherResp.Wind.Deg,
+			sample.Time,
+			sample.City,
+			sample.Temp,
+			sample.FeelsLike,
+			sample.Pressure,
+			sample.WindSpeed,
+			sample.WindDeg,
 		); err != nil {
-			return fmt.Errorf("insertWeatherResponses: append to batch: %w", err)
+			return fmt.Errorf("InsertWeather: append to batch: %w", err)
 		}
 	}
 
+	clickhouseBatchSize.WithLabelValues("weather_metrics").Observe(float64(len(samples)))
 	if err := batch.Send(); err != nil {
-		return fmt.Errorf("insertWeatherResponses: send batch: %w", err)
+		return fmt.Errorf("InsertWeather: send batch: %w", err)
 	}
-
 	return nil
 }
 
-func startPeriodicTask(intervalSeconds int) {
-	log.Println("start_periodic_task")
-
-	go func() {
-		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
-		defer ticker.Stop()
+func (c *ClickHouseStore) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
 
-		for range ticker.C {
-			if err := insertWeatherData(MapOfCities); err != nil {
-				log.Printf("Periodic task error: %v", err)
-			} else {
-				log.Println("Periodic task: Weather data inserted successfully")
-			}
-		}
-	}()
+func (c *ClickHouseStore) Close() error {
+	if err := c.conn.Close(); err != nil {
+		return fmt.Errorf("ClickHouseStore.Close: %w", err)
+	}
+	return nil
 }
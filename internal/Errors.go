@@ -0,0 +1,107 @@
+package weatherservice
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
+)
+
+// Error kinds. Match them with errors.Is; every *Error wraps exactly one.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrWrongPassword = errors.New("incorrect password")
+	ErrValidation    = errors.New("validation failed")
+	ErrConflict      = errors.New("conflict")
+	ErrUnavailable   = errors.New("upstream unavailable")
+
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// Error is a domain error. Message is safe to show to clients, Err is the
+// underlying cause and only ends up in logs.
+type Error struct {
+	Kind    error
+	Message string
+	Err     error
+	// Details lists the offending fields of validation errors.
+	Details []FieldError
+	// RetryAfter tells rate-limited clients when to come back.
+	RetryAfter time.Duration
+}
+
+func newError(kind error, message string, err error) *Error {
+	return &Error{Kind: kind, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Kind}
+}
+
+var errorKinds = []struct {
+	kind   error
+	status int
+	code   api.ErrorDetailCode
+}{
+	{ErrNotFound, http.StatusNotFound, api.NotFound},
+	{ErrWrongPassword, http.StatusUnauthorized, api.WrongPassword},
+	{ErrValidation, http.StatusBadRequest, api.ValidationFailed},
+	{ErrConflict, http.StatusConflict, api.Conflict},
+	{ErrUnavailable, http.StatusServiceUnavailable, api.UpstreamUnavailable},
+	{ErrTooManyRequests, http.StatusTooManyRequests, api.TooManyRequests},
+}
+
+// writeError logs err and answers with the JSON envelope matching its kind.
+// Errors that are not *Error are reported as a generic internal error.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var domainErr *Error
+	if errors.As(err, &domainErr) {
+		for _, k := range errorKinds {
+			if errors.Is(domainErr.Kind, k.kind) {
+				level := slog.LevelInfo
+				if k.status >= http.StatusInternalServerError {
+					level = slog.LevelError
+				}
+				slog.Log(r.Context(), level, "request failed", "status", k.status, "err", err)
+				if domainErr.RetryAfter > 0 {
+					seconds := int64(math.Ceil(domainErr.RetryAfter.Seconds()))
+					w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+				}
+				writeErrorDetails(w, r, k.status, k.code, domainErr.Message, domainErr.Details)
+				return
+			}
+		}
+	}
+	slog.ErrorContext(r.Context(), "request failed", "status", http.StatusInternalServerError, "err", err)
+	writeErrorStatus(w, r, http.StatusInternalServerError, api.Internal, "internal server error")
+}
+
+func writeErrorStatus(w http.ResponseWriter, r *http.Request, status int, code api.ErrorDetailCode, message string) {
+	writeErrorDetails(w, r, status, code, message, nil)
+}
+
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, code api.ErrorDetailCode, message string, details []FieldError) {
+	resp := api.Error{Error: api.ErrorDetail{Code: code, Message: message}}
+	if id := requestID(r); id != "" {
+		resp.Error.RequestId = &id
+	}
+	if len(details) > 0 {
+		resp.Error.Details = &details
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, status, resp)
+}
@@ -1,83 +1,101 @@
 package weatherservice
 
 import (
-	"fmt"
+	"encoding/json"
+	"log/slog"
 	"net/http"
-	"strings"
-	"log"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
 )
 
-func Handler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// Handler returns the HTTP handler serving every API version.
+func (s *Service) Handler() http.Handler {
+	rt := NewRouter(
+		Recover,
+		RequestID,
+		InstrumentRequests,
+		TraceRequests,
+		LogRequests,
+		JSONResponses,
+		LimitBody(maxBodyBytes),
+		ValidateSpec,
+	)
+
+	// Probes and scrapes are not rate limited: they come from one address
+	// and a 429 would read as an unhealthy instance.
+	rt.HandleFunc(http.MethodGet, "/healthz", s.serveHealthz)
+	rt.HandleFunc(http.MethodGet, "/readyz", s.serveReadyz)
+	rt.Handle(http.MethodGet, "/metrics", serveMetrics())
+
+	// handle registers an API route behind the per-IP rate limit.
+	handle := func(method, pattern string, h http.HandlerFunc, mw ...Middleware) {
+		rt.HandleFunc(method, pattern, h, append([]Middleware{s.LimitRate}, mw...)...)
+	}
+
+	handle(http.MethodGet, "/v1/openapi.json", serveOpenAPI)
+	handle(http.MethodPost, "/v1/createUser", s.handleCreateUser)
+	handle(http.MethodPost, "/v1/changeUserData", s.handleChangeUserData)
+	// The first version accepted any method but GET here.
+	handle(http.MethodPut, "/v1/changeUserData", s.handleChangeUserData)
+	handle(http.MethodPatch, "/v1/changeUserData", s.handleChangeUserData)
+	handle(http.MethodPost, "/v1/getUserData", s.handleGetUserData)
+	handle(http.MethodDelete, "/v1/deleteUser", s.handleDeleteUser)
 
-	log.Printf("Handler: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	handle(http.MethodPost, "/v2/users", s.postUsers)
+	handle(http.MethodGet, "/v2/users/me", s.getMe, s.RequireUser)
+	handle(http.MethodPatch, "/v2/users/me", s.patchMe, s.RequireUser)
+	handle(http.MethodDelete, "/v2/users/me", s.deleteMe, s.RequireUser)
+	handle(http.MethodGet, "/v2/users/me/cities", s.getMyCities, s.RequireUser)
+	handle(http.MethodGet, "/v2/users/me/cities/{id}", s.getMyCity, s.RequireUser)
+	handle(http.MethodPost, "/v2/users/me/cities/{id}", s.postMyCity, s.RequireUser)
+	handle(http.MethodDelete, "/v2/users/me/cities/{id}", s.deleteMyCity, s.RequireUser)
 
-	switch r.URL.Path {
+	return rt
+}
 
-	case "/v1/createUser":
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
-			return
-		}
-		if err := createUser(r); err != nil {
-			log.Printf("Handler: createUser error: %v", err)
-			http.Error(w, fmt.Sprintf("RegisterUser error: %v", err), http.StatusBadRequest)
-			return
-		}
-		log.Printf("Handler: user created successfully")
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(`{"message": "User registered successfully"}`))
+func (s *Service) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	if err := s.createUser(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "handleCreateUser: user created")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"message": "User registered successfully"}`))
+}
 
-	case "/v1/changeUserData":
-		if r.Method == http.MethodGet {
-			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		if err := changeUserData(r); err != nil {
-			log.Printf("Handler: changeUserData error: %v", err)
-           	http.Error(w, fmt.Sprintf("changeUserData error: %v", err), http.StatusBadRequest)
-			return
-		}
-		log.Printf("Handler: user data updated successfully")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"message": "User data updated successfully"}`))
+func (s *Service) handleChangeUserData(w http.ResponseWriter, r *http.Request) {
+	if err := s.changeUserData(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "handleChangeUserData: user data updated")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "User data updated successfully"}`))
+}
 
-	 case "/v1/getUserData":
-        if r.Method != http.MethodPost {
-            log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
-            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-            return
-        }
-        userData, err := getUserData(r)
-        if err != nil {
-            log.Printf("Handler: getUserData error: %v", err)
-            http.Error(w, fmt.Sprintf("getUserData error: %v", err), http.StatusBadRequest)
-            return
-        }
-        log.Printf("Handler: user data fetched for %s", userData.Email)
-        response := fmt.Sprintf(`{"email": "%s", "cities": ["%s"]}`, userData.Email, strings.Join(userData.Cities, `","`))
-        w.WriteHeader(http.StatusOK)
-        w.Write([]byte(response))
+func (s *Service) handleGetUserData(w http.ResponseWriter, r *http.Request) {
+	userData, err := s.getUserData(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "handleGetUserData: user data fetched", "email", userData.Email)
+	writeJSON(w, http.StatusOK, api.User{Email: userData.Email, Cities: userData.Cities})
+}
 
-    case "/v1/deleteUser":
-        if r.Method != http.MethodDelete {
-            log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
-            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-            return
-        }
-        if err := deleteUser(r); err != nil {
-            log.Printf("Handler: deleteUser error: %v", err)
-            http.Error(w, fmt.Sprintf("deleteUser error: %v", err), http.StatusBadRequest)
-            return
-        }
-        log.Printf("Handler: user deleted successfully")
-        w.WriteHeader(http.StatusOK)
-        w.Write([]byte(`{"message": "User deleted successfully"}`))
+func (s *Service) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if err := s.deleteUser(r); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "handleDeleteUser: user deleted")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"message": "User deleted successfully"}`))
+}
 
-    default:
-        log.Printf("Handler: not found %s %s", r.Method, r.URL.Path)
-        http.Error(w, "Not found", http.StatusNotFound)
-    }
-}
\ No newline at end of file
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("writeJSON: encode error", "err", err)
+	}
+}
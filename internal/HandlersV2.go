@@ -0,0 +1,140 @@
+package weatherservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
+)
+
+// The /v2 handlers below are resource-oriented; every /v2/users/me route runs
+// behind RequireUser.
+
+const citiesPath = "/v2/users/me/cities/"
+
+func (s *Service) postUsers(w http.ResponseWriter, r *http.Request) {
+	var req UserData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, newError(ErrValidation, "invalid JSON body", fmt.Errorf("postUsers: decode error: %w", err)))
+		return
+	}
+	if err := validateNewUser(&req); err != nil {
+		writeError(w, r, fmt.Errorf("postUsers: %w", err))
+		return
+	}
+
+	if err := s.registerUser(r.Context(), req); err != nil {
+		writeError(w, r, fmt.Errorf("postUsers: %w", err))
+		return
+	}
+
+	w.Header().Set("Location", "/v2/users/me")
+	writeJSON(w, http.StatusCreated, api.User{Email: req.Email, Cities: req.Cities})
+}
+
+func (s *Service) getMe(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	writeJSON(w, http.StatusOK, api.User{Email: user.Email, Cities: user.Cities})
+}
+
+func (s *Service) patchMe(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	var req api.UserPatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, newError(ErrValidation, "invalid JSON body", fmt.Errorf("patchMe: decode error: %w", err)))
+		return
+	}
+
+	// Both fields are validated before either is changed.
+	cities, err := validateUserPatch(req.Password, req.Cities)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("patchMe: %w", err))
+		return
+	}
+	if err := s.updateUser(r.Context(), user.Email, req.Password, cities); err != nil {
+		writeError(w, r, fmt.Errorf("patchMe: %w", err))
+		return
+	}
+	if cities != nil {
+		user.Cities = cities
+	}
+
+	writeJSON(w, http.StatusOK, api.User{Email: user.Email, Cities: user.Cities})
+}
+
+func (s *Service) deleteMe(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	if err := s.removeUser(r.Context(), user.Email); err != nil {
+		writeError(w, r, fmt.Errorf("deleteMe: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) getMyCities(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	cities := make([]api.City, 0, len(user.Cities))
+	for _, city := range user.Cities {
+		cities = append(cities, api.City{City: city})
+	}
+	writeJSON(w, http.StatusOK, cities)
+}
+
+func (s *Service) getMyCity(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	city, ok := cityParam(w, r)
+	if !ok {
+		return
+	}
+	for _, c := range user.Cities {
+		if c == city {
+			writeJSON(w, http.StatusOK, api.City{City: c})
+			return
+		}
+	}
+	writeError(w, r, newError(ErrNotFound, "city not found", nil))
+}
+
+func (s *Service) postMyCity(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	city, ok := cityParam(w, r)
+	if !ok {
+		return
+	}
+	if err := s.addUserCity(r.Context(), user.Email, city); err != nil {
+		writeError(w, r, fmt.Errorf("postMyCity: %w", err))
+		return
+	}
+	w.Header().Set("Location", citiesPath+url.PathEscape(city))
+	writeJSON(w, http.StatusCreated, api.City{City: city})
+}
+
+func (s *Service) deleteMyCity(w http.ResponseWriter, r *http.Request) {
+	user := userFrom(r)
+	city, ok := cityParam(w, r)
+	if !ok {
+		return
+	}
+	removed, err := s.removeUserCity(r.Context(), user.Email, city)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("deleteMyCity: %w", err))
+		return
+	}
+	if !removed {
+		writeError(w, r, newError(ErrNotFound, "city not found", nil))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cityParam returns the normalized {id} path parameter.
+func cityParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	city, err := validateCity(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, fmt.Errorf("cityParam: %w", err))
+		return "", false
+	}
+	return city, true
+}
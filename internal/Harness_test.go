@@ -0,0 +1,234 @@
+package weatherservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+)
+
+const testAPIKey = "test-key"
+
+// fakeOpenWeather serves the geocoding and current weather endpoints for a
+// fixed set of cities. Requests without the test API key get 401, as they
+// would from the real API.
+type fakeOpenWeather struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	cities       map[string]CityType
+	failWeather  bool
+	geocodeCalls int
+	weatherCalls int
+}
+
+func newFakeOpenWeather(t *testing.T) *fakeOpenWeather {
+	f := &fakeOpenWeather{cities: map[string]CityType{
+		"moscow": {Name: "Moscow", Lat: 55.75, Lon: 37.62},
+		"london": {Name: "London", Lat: 51.51, Lon: -0.13},
+		"paris":  {Name: "Paris", Lat: 48.86, Lon: 2.35},
+	}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/geo/1.0/direct", f.geocode)
+	mux.HandleFunc("/data/2.5/weather", f.weather)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOpenWeather) config() config.OpenWeather {
+	return config.OpenWeather{
+		APIKey:       testAPIKey,
+		WeatherURL:   f.URL + "/data/2.5/weather",
+		GeocodingURL: f.URL + "/geo/1.0/direct",
+	}
+}
+
+func (f *fakeOpenWeather) geocode(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("appid") != testAPIKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.geocodeCalls++
+
+	results := []CityType{}
+	if city, ok := f.cities[strings.ToLower(r.URL.Query().Get("q"))]; ok {
+		results = append(results, city)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// weather reports a temperature derived from the latitude so that tests can
+// tell the samples of different cities apart.
+func (f *fakeOpenWeather) weather(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("appid") != testAPIKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.weatherCalls++
+	if f.failWeather {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	var lat float32
+	for _, city := range f.cities {
+		if r.URL.Query().Get("lat") == fmt.Sprintf("%f", city.Lat) {
+			lat = city.Lat
+		}
+	}
+	fmt.Fprintf(w, `{"dt": %d, "main": {"temp": %g, "feels_like": %g, "pressure": 1012}, "wind": {"speed": 3.5, "deg": 270}}`,
+		time.Now().Unix(), lat/10, lat/10-2)
+}
+
+func (f *fakeOpenWeather) setFailWeather(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failWeather = fail
+}
+
+func (f *fakeOpenWeather) calls() (geocode, weather int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.geocodeCalls, f.weatherCalls
+}
+
+// brokenPublisher fails every publish while down, like a publisher whose
+// broker is unreachable.
+type brokenPublisher struct {
+	Publisher
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (b *brokenPublisher) Publish(ctx context.Context, task EmailTask) error {
+	b.mu.Lock()
+	down := b.down
+	b.mu.Unlock()
+	if down {
+		return errors.New("broker unreachable")
+	}
+	return b.Publisher.Publish(ctx, task)
+}
+
+func (b *brokenPublisher) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = down
+}
+
+// harness runs the API handler over in-memory stores and the fake provider.
+type harness struct {
+	t         *testing.T
+	svc       *Service
+	server    *httptest.Server
+	provider  *fakeOpenWeather
+	users     *MemoryUserStore
+	metrics   *MemoryMetricsStore
+	publisher *MemoryPublisher
+	broker    *brokenPublisher
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	h := &harness{
+		t:         t,
+		provider:  newFakeOpenWeather(t),
+		users:     NewMemoryUserStore(),
+		metrics:   NewMemoryMetricsStore(),
+		publisher: NewMemoryPublisher(),
+	}
+	h.broker = &brokenPublisher{Publisher: h.publisher}
+	h.svc = NewService(Deps{
+		Users:     h.users,
+		Metrics:   h.metrics,
+		Provider:  NewOpenWeather(h.provider.config()),
+		Publisher: h.broker,
+	}, Options{IngestionInterval: time.Hour, OutboxInterval: time.Hour, OutboxBatch: 10})
+	h.server = httptest.NewServer(h.svc.Handler())
+	t.Cleanup(h.server.Close)
+	return h
+}
+
+// do sends body, if not nil, as JSON and returns the status code, decoding
+// the response into out if it is not nil.
+func (h *harness) do(method, path string, body, out any) int {
+	h.t.Helper()
+	return h.doAuth(method, path, "", "", body, out)
+}
+
+// doAuth is do with HTTP Basic credentials, unless email is empty.
+func (h *harness) doAuth(method, path, email, password string, body, out any) int {
+	h.t.Helper()
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			h.t.Fatalf("marshal request: %v", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, h.server.URL+path, reqBody)
+	if err != nil {
+		h.t.Fatalf("new request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if email != "" {
+		req.SetBasicAuth(email, password)
+	}
+
+	resp, err := h.server.Client().Do(req)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			h.t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// expect fails the test unless do returns status.
+func (h *harness) expect(status int, method, path string, body, out any) {
+	h.t.Helper()
+	if got := h.do(method, path, body, out); got != status {
+		h.t.Fatalf("%s %s: status %d, want %d", method, path, got, status)
+	}
+}
+
+// tick runs one ingestion cycle.
+func (h *harness) tick() {
+	h.svc.runIngestion(5 * time.Second)
+}
+
+// relay runs the outbox relay once.
+func (h *harness) relay() {
+	h.svc.relayOutbox(5 * time.Second)
+}
@@ -0,0 +1,154 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+
+	// The provider is probed at most once per providerProbeInterval so that
+	// frequent probes do not eat into the OpenWeather quota.
+	providerProbeInterval = time.Minute
+)
+
+type healthCheck struct {
+	name     string
+	critical bool
+	run      func(ctx context.Context) (age time.Duration, err error)
+}
+
+func (s *Service) healthChecks() []healthCheck {
+	return []healthCheck{
+		{name: "postgres", critical: true, run: pingCheck(s.users.Ping)},
+		{name: "clickhouse", critical: true, run: pingCheck(s.metrics.Ping)},
+		{name: "rabbitmq", critical: false, run: pingCheck(s.publisher.Ping)},
+		{name: "ingestion", critical: false, run: s.checkIngestion},
+		{name: "provider", critical: false, run: s.checkProvider},
+	}
+}
+
+func pingCheck(ping func(context.Context) error) func(context.Context) (time.Duration, error) {
+	return func(ctx context.Context) (time.Duration, error) {
+		return 0, ping(ctx)
+	}
+}
+
+// runHealthChecks runs every check concurrently and summarizes them. The
+// result is "fail" if a critical check fails and "degraded" if only
+// non-critical ones do.
+func (s *Service) runHealthChecks(ctx context.Context) api.Health {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	healthChecks := s.healthChecks()
+
+	results := make([]api.Check, len(healthChecks))
+	var wg sync.WaitGroup
+	for i, hc := range healthChecks {
+		wg.Add(1)
+		go func(i int, hc healthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			age, err := hc.run(ctx)
+			latency := int(time.Since(start).Milliseconds())
+
+			res := api.Check{Status: api.CheckStatusOk, Critical: hc.critical, LatencyMs: &latency}
+			if age > 0 {
+				seconds := int(age.Seconds())
+				res.AgeSeconds = &seconds
+			}
+			if err != nil {
+				msg := err.Error()
+				res.Status = api.CheckStatusFail
+				res.Error = &msg
+			}
+			results[i] = res
+		}(i, hc)
+	}
+	wg.Wait()
+
+	health := api.Health{Status: api.HealthStatusOk, Checks: make(map[string]api.Check, len(results))}
+	for i, res := range results {
+		health.Checks[healthChecks[i].name] = res
+		if res.Status == api.CheckStatusOk {
+			continue
+		}
+		if res.Critical {
+			health.Status = api.HealthStatusFail
+		} else if health.Status == api.HealthStatusOk {
+			health.Status = api.HealthStatusDegraded
+		}
+	}
+	return health
+}
+
+// serveHealthz answers liveness probes. Dependency failures are reported but
+// do not fail the probe: restarting the process would not fix them.
+func (s *Service) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.runHealthChecks(r.Context()))
+}
+
+// serveReadyz answers readiness probes with 503 while a critical dependency
+// is down or the process is shutting down.
+func (s *Service) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	health := s.runHealthChecks(r.Context())
+	if s.shuttingDown.Load() {
+		msg := "shutting down"
+		health.Status = api.HealthStatusFail
+		health.Checks["lifecycle"] = api.Check{Status: api.CheckStatusFail, Critical: true, Error: &msg}
+	}
+
+	status := http.StatusOK
+	if health.Status == api.HealthStatusFail {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
+
+// checkIngestion fails once no ingestion cycle has succeeded for three
+// intervals.
+func (s *Service) checkIngestion(ctx context.Context) (time.Duration, error) {
+	limit := 3 * s.ingestionInterval
+	last := s.lastIngestion()
+	if last.IsZero() {
+		if since := time.Since(s.startedAt); since > limit {
+			return since, fmt.Errorf("no successful cycle since start %s ago", since.Round(time.Second))
+		}
+		return 0, nil
+	}
+	age := time.Since(last)
+	if age > limit {
+		return age, fmt.Errorf("last successful cycle %s ago", age.Round(time.Second))
+	}
+	return age, nil
+}
+
+type providerProbe struct {
+	sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// checkProvider pings the weather provider, reusing the last result for
+// providerProbeInterval.
+func (s *Service) checkProvider(ctx context.Context) (time.Duration, error) {
+	probe := &s.providerProbe
+	probe.Lock()
+	defer probe.Unlock()
+
+	if time.Since(probe.checkedAt) < providerProbeInterval {
+		return 0, probe.err
+	}
+
+	err := s.provider.Ping(ctx)
+	probe.checkedAt = time.Now()
+	probe.err = err
+	return 0, err
+}
@@ -0,0 +1,150 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// addCities geocodes the cities that are not registered yet and stores them.
+func (s *Service) addCities(ctx context.Context, cities []string) error {
+	resolved, err := s.resolveCities(ctx, cities)
+	if err != nil {
+		return fmt.Errorf("addCities: %w", err)
+	}
+
+	if err := s.storeCities(ctx, resolved); err != nil {
+		return fmt.Errorf("addCities: %w", err)
+	}
+
+	return nil
+}
+
+// resolveCities geocodes the cities that are not registered yet without
+// storing them anywhere.
+func (s *Service) resolveCities(ctx context.Context, cities []string) (map[string]CityType, error) {
+	return s.cities.Resolve(cities, func(name string) (CityType, error) {
+		return s.provider.Coordinates(ctx, name)
+	})
+}
+
+// storeCities writes resolved cities to the metrics store and registers them.
+func (s *Service) storeCities(ctx context.Context, cities map[string]CityType) error {
+	if err := s.cities.Add(ctx, cities, s.metrics.InsertCities); err != nil {
+		return newError(ErrUnavailable, "metrics store unavailable", fmt.Errorf("storeCities: %w", err))
+	}
+
+	return nil
+}
+
+// ingest collects the current weather of every registered city and stores it
+// as one batch. A single failed city fails the whole cycle.
+func (s *Service) ingest(ctx context.Context, cities map[string]CityType) error {
+	samples := make([]WeatherSample, 0, len(cities))
+	for cityName, city := range cities {
+		sample, err := s.provider.CurrentWeather(ctx, city)
+		if err != nil {
+			return fmt.Errorf("ingest: get weather for city %s: %w", cityName, err)
+		}
+		// Samples are stored under the name users asked for, which may
+		// differ from the one the provider returns.
+		sample.City = cityName
+		samples = append(samples, sample)
+	}
+
+	if err := s.metrics.InsertWeather(ctx, samples); err != nil {
+		return fmt.Errorf("ingest: %w", err)
+	}
+
+	for cityName := range cities {
+		ingestionSamples.WithLabelValues(cityName).Inc()
+	}
+	return nil
+}
+
+// periodicTask calls run every interval, or sooner when woken, until stopped.
+type periodicTask struct {
+	stop chan struct{}
+	done chan struct{}
+	wake chan struct{}
+}
+
+func startPeriodicTask(name string, interval time.Duration, run func()) *periodicTask {
+	slog.Info("startPeriodicTask: started", "task", name, "interval", interval)
+
+	t := &periodicTask{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+	}
+
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.stop:
+				slog.Info("Periodic task: stopped", "task", name)
+				return
+			case <-ticker.C:
+			case <-t.wake:
+			}
+
+			run()
+		}
+	}()
+
+	return t
+}
+
+// Wake makes the task run as soon as the current run, if any, finishes.
+func (t *periodicTask) Wake() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runIngestion is one tick of the ingestion loop. The cycle may take at most
+// timeout, so that it does not run into the next one.
+func (s *Service) runIngestion(timeout time.Duration) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "ingestion cycle")
+	snapshot := s.cities.Snapshot()
+	err := s.ingest(ctx, snapshot)
+	endSpan(span, err)
+	ingestionDuration.Observe(time.Since(start).Seconds())
+	ingestionCycles.WithLabelValues(outcome(err)).Inc()
+	if err != nil {
+		slog.ErrorContext(ctx, "Periodic task: ingestion failed", "err", err)
+	} else {
+		s.lastIngestionNano.Store(time.Now().UnixNano())
+		slog.InfoContext(ctx, "Periodic task: weather data inserted", "cities", len(snapshot))
+	}
+}
+
+// Stop prevents further runs and waits for the one in progress, if any, to
+// send its batch.
+func (t *periodicTask) Stop(ctx context.Context) error {
+	close(t.stop)
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("periodicTask.Stop: %w", ctx.Err())
+	}
+}
+
+func (s *Service) lastIngestion() time.Time {
+	nano := s.lastIngestionNano.Load()
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
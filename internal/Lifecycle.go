@@ -0,0 +1,78 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Serve runs the API on addr until ctx is cancelled, then shuts the process
+// down: the listener is closed, in-flight requests are drained, the running
+// ingestion batch is finished and every connection is closed. All of that has
+// to fit into shutdownTimeout.
+func (s *Service) Serve(ctx context.Context, addr string, shutdownTimeout time.Duration) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Serve: listening", "addr", addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return errors.Join(fmt.Errorf("Serve: %w", err), s.Shutdown(shutdownCtx))
+	case <-ctx.Done():
+	}
+
+	slog.Info("Serve: shutting down", "deadline", shutdownTimeout)
+	s.shuttingDown.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, fmt.Errorf("Serve: http shutdown: %w", err))
+	}
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown stops the background work and closes every backend. Each one is
+// closed even if an earlier step failed or the deadline passed.
+func (s *Service) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, task := range []*periodicTask{s.ingestion, s.outbox} {
+		if task == nil {
+			continue
+		}
+		if err := task.Stop(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, closer := range []io.Closer{s.publisher, s.users, s.metrics} {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Last, so that spans from the steps above are flushed too.
+	if err := CloseTracing(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		slog.Info("Shutdown: complete")
+	}
+	return errors.Join(errs...)
+}
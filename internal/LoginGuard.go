@@ -0,0 +1,92 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// An account is locked once it collects lockoutThreshold wrong passwords
+	// within failureWindow.
+	lockoutThreshold = 5
+	failureWindow    = time.Hour
+
+	// The first lockout lasts lockoutBase and every further failure doubles
+	// it, up to lockoutMax.
+	lockoutBase = time.Minute
+	lockoutMax  = time.Hour
+)
+
+// checkLoginAllowed is called before a password is verified. It enforces the
+// per-email rate limit and any active lockout.
+func (s *Service) checkLoginAllowed(ctx context.Context, email string) error {
+	if ok, wait := s.emailLimiter.allow(email); !ok {
+		return tooManyRequests(wait, fmt.Errorf("checkLoginAllowed: email %s over limit", email))
+	}
+
+	lockedUntil, err := s.users.LockedUntil(ctx, email)
+	if err != nil {
+		slog.ErrorContext(ctx, "checkLoginAllowed: select error", "err", err)
+		return fmt.Errorf("checkLoginAllowed: %w", err)
+	}
+
+	if lockedUntil.After(time.Now()) {
+		return tooManyRequests(time.Until(lockedUntil), fmt.Errorf("checkLoginAllowed: %s locked until %s", email, lockedUntil))
+	}
+	return nil
+}
+
+// recordLoginFailure counts a wrong password and locks the account once the
+// threshold is reached, queueing an email to the owner.
+func (s *Service) recordLoginFailure(ctx context.Context, email string) {
+	failures, err := s.users.RecordLoginFailure(ctx, email, failureWindow)
+	if err != nil {
+		slog.ErrorContext(ctx, "recordLoginFailure: upsert error", "err", err)
+		return
+	}
+
+	if failures < lockoutThreshold {
+		return
+	}
+
+	lockout := lockoutDuration(failures)
+	lockedUntil := time.Now().Add(lockout)
+	if err := s.users.LockUser(ctx, email, lockedUntil, lockoutNotice(email, failures, lockedUntil)); err != nil {
+		slog.ErrorContext(ctx, "recordLoginFailure: lock error", "err", err)
+		return
+	}
+	slog.WarnContext(ctx, "recordLoginFailure: account locked", "email", email, "lockout", lockout, "failures", failures)
+	s.wakeOutbox()
+}
+
+func (s *Service) clearLoginFailures(ctx context.Context, email string) {
+	if err := s.users.ClearLoginFailures(ctx, email); err != nil {
+		slog.ErrorContext(ctx, "clearLoginFailures: delete error", "err", err)
+	}
+}
+
+func lockoutDuration(failures int) time.Duration {
+	lockout := lockoutBase
+	for i := lockoutThreshold; i < failures && lockout < lockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > lockoutMax {
+		lockout = lockoutMax
+	}
+	return lockout
+}
+
+// lockoutNotice is the email telling the owner that the account is locked.
+func lockoutNotice(email string, failures int, lockedUntil time.Time) EmailTask {
+	return EmailTask{
+		Key:  newEmailKey(),
+		To:   email,
+		Type: "account_locked",
+		Meta: map[string]interface{}{
+			"failures":     failures,
+			"locked_until": lockedUntil.UTC().Format(time.RFC3339),
+		},
+	}
+}
@@ -0,0 +1,291 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryUserStore is a UserStore kept in process memory, for running without
+// Postgres. Its contents are lost on restart.
+type MemoryUserStore struct {
+	mu       sync.Mutex
+	users    map[string]StoredUser
+	failures map[string]*loginFailures
+
+	// outbox holds the queued emails not sent yet, oldest first.
+	outbox       []OutboxEmail
+	lastOutboxID int64
+	// relayMu keeps concurrent RelayEmails calls from sending an email twice.
+	relayMu sync.Mutex
+}
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:    make(map[string]StoredUser),
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+func (m *MemoryUserStore) GetUser(ctx context.Context, email string) (StoredUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return StoredUser{}, newError(ErrNotFound, "user not found", nil)
+	}
+	user.Cities = slices.Clone(user.Cities)
+	return user, nil
+}
+
+// CreateUser stores user once commit succeeds. The email is checked again
+// after commit so that concurrent registrations still conflict.
+func (m *MemoryUserStore) CreateUser(ctx context.Context, user StoredUser, commit func(context.Context) error) error {
+	if m.exists(user.Email) {
+		return newError(ErrConflict, "user already exists", nil)
+	}
+	if err := commit(ctx); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[user.Email]; ok {
+		return newError(ErrConflict, "user already exists", nil)
+	}
+	user.Cities = slices.Clone(user.Cities)
+	m.users[user.Email] = user
+	return nil
+}
+
+func (m *MemoryUserStore) exists(email string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.users[email]
+	return ok
+}
+
+// update applies fn to the user with email, if there is one. Like the SQL
+// updates it stands in for, a missing user is not an error.
+func (m *MemoryUserStore) update(email string, fn func(*StoredUser)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if user, ok := m.users[email]; ok {
+		fn(&user)
+		m.users[email] = user
+	}
+}
+
+func (m *MemoryUserStore) SetCities(ctx context.Context, email string, cities []string) error {
+	m.update(email, func(u *StoredUser) { u.Cities = slices.Clone(cities) })
+	return nil
+}
+
+func (m *MemoryUserStore) AddCity(ctx context.Context, email, city string) error {
+	m.update(email, func(u *StoredUser) {
+		if !slices.Contains(u.Cities, city) {
+			u.Cities = append(slices.Clone(u.Cities), city)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryUserStore) RemoveCity(ctx context.Context, email, city string) (bool, error) {
+	var removed bool
+	m.update(email, func(u *StoredUser) {
+		if slices.Contains(u.Cities, city) {
+			u.Cities = slices.DeleteFunc(slices.Clone(u.Cities), func(c string) bool { return c == city })
+			removed = true
+		}
+	})
+	return removed, nil
+}
+
+func (m *MemoryUserStore) UpdateUser(ctx context.Context, email string, passwordHash *string, cities []string) error {
+	m.update(email, func(u *StoredUser) {
+		if passwordHash != nil {
+			u.PasswordHash = *passwordHash
+		}
+		if cities != nil {
+			u.Cities = slices.Clone(cities)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryUserStore) DeleteUser(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, email)
+	return nil
+}
+
+func (m *MemoryUserStore) LockedUntil(ctx context.Context, email string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[email]; ok {
+		return f.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (m *MemoryUserStore) RecordLoginFailure(ctx context.Context, email string, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	f, ok := m.failures[email]
+	if !ok {
+		f = &loginFailures{}
+		m.failures[email] = f
+	}
+	if now.Sub(f.lastFailure) > window {
+		f.count = 0
+	}
+	f.count++
+	f.lastFailure = now
+	return f.count, nil
+}
+
+func (m *MemoryUserStore) LockUser(ctx context.Context, email string, until time.Time, notice EmailTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[email]; ok {
+		f.lockedUntil = until
+	}
+	m.lastOutboxID++
+	m.outbox = append(m.outbox, OutboxEmail{ID: m.lastOutboxID, Task: notice, Trace: traceContext(ctx)})
+	return nil
+}
+
+func (m *MemoryUserStore) RelayEmails(ctx context.Context, limit int, publish func(context.Context, OutboxEmail) error) (int, error) {
+	m.relayMu.Lock()
+	defer m.relayMu.Unlock()
+
+	m.mu.Lock()
+	pending := slices.Clone(m.outbox[:min(limit, len(m.outbox))])
+	m.mu.Unlock()
+
+	sent := 0
+	for _, e := range pending {
+		if err := publish(ctx, e); err != nil {
+			m.dropSent(sent)
+			return sent, fmt.Errorf("RelayEmails: publish email %d: %w", e.ID, err)
+		}
+		sent++
+	}
+	m.dropSent(sent)
+	return sent, nil
+}
+
+// dropSent removes the n oldest emails, which RelayEmails has sent.
+func (m *MemoryUserStore) dropSent(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outbox = m.outbox[n:]
+}
+
+// PendingEmails returns the queued emails not sent yet.
+func (m *MemoryUserStore) PendingEmails() []OutboxEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.outbox)
+}
+
+func (m *MemoryUserStore) ClearLoginFailures(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, email)
+	return nil
+}
+
+func (m *MemoryUserStore) Ping(ctx context.Context) error { return nil }
+
+func (m *MemoryUserStore) Close() error { return nil }
+
+// MemoryMetricsStore is a MetricsStore kept in process memory, for running
+// without ClickHouse.
+type MemoryMetricsStore struct {
+	mu      sync.Mutex
+	cities  map[string]CityType
+	samples []WeatherSample
+}
+
+func NewMemoryMetricsStore() *MemoryMetricsStore {
+	return &MemoryMetricsStore{cities: make(map[string]CityType)}
+}
+
+func (m *MemoryMetricsStore) LoadCities(ctx context.Context) (map[string]CityType, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cities := make(map[string]CityType, len(m.cities))
+	for name, city := range m.cities {
+		cities[name] = city
+	}
+	return cities, nil
+}
+
+func (m *MemoryMetricsStore) InsertCities(ctx context.Context, cities map[string]CityType) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, city := range cities {
+		m.cities[name] = city
+	}
+	return nil
+}
+
+func (m *MemoryMetricsStore) InsertWeather(ctx context.Context, samples []WeatherSample) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, samples...)
+	return nil
+}
+
+// Samples returns every weather sample inserted so far.
+func (m *MemoryMetricsStore) Samples() []WeatherSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.samples)
+}
+
+func (m *MemoryMetricsStore) Ping(ctx context.Context) error { return nil }
+
+func (m *MemoryMetricsStore) Close() error { return nil }
+
+// MemoryPublisher is a Publisher that keeps email tasks instead of sending
+// them; they are logged so that a local run shows what would be mailed.
+type MemoryPublisher struct {
+	mu    sync.Mutex
+	tasks []EmailTask
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (m *MemoryPublisher) Publish(ctx context.Context, task EmailTask) error {
+	m.mu.Lock()
+	m.tasks = append(m.tasks, task)
+	m.mu.Unlock()
+	slog.InfoContext(ctx, "MemoryPublisher: email task", "to", task.To, "type", task.Type, "meta", task.Meta)
+	return nil
+}
+
+// Published returns every task published so far.
+func (m *MemoryPublisher) Published() []EmailTask {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.tasks)
+}
+
+func (m *MemoryPublisher) Ping(ctx context.Context) error { return nil }
+
+func (m *MemoryPublisher) Close() error { return nil }
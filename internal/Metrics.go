@@ -0,0 +1,124 @@
+package weatherservice
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_http_requests_total",
+		Help: "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "weather_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	providerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_provider_requests_total",
+		Help: "OpenWeather API calls by endpoint and outcome.",
+	}, []string{"endpoint", "outcome"})
+
+	providerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "weather_provider_request_duration_seconds",
+		Help:    "OpenWeather API call latency by endpoint.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	ingestionCycles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_ingestion_cycles_total",
+		Help: "Ingestion cycles by outcome.",
+	}, []string{"outcome"})
+
+	ingestionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "weather_ingestion_cycle_duration_seconds",
+		Help:    "Duration of a whole ingestion cycle.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+
+	ingestionSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_ingestion_samples_total",
+		Help: "Weather samples collected per city.",
+	}, []string{"city"})
+
+	clickhouseBatchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "weather_clickhouse_batch_rows",
+		Help:    "Rows sent per ClickHouse batch by table.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"table"})
+
+	emailPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_email_tasks_published_total",
+		Help: "Email tasks handed to RabbitMQ by type and outcome.",
+	}, []string{"type", "outcome"})
+)
+
+func serveMetrics() http.Handler {
+	return promhttp.Handler()
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+type routeKey struct{}
+
+// routeHolder lets the router report the pattern it matched, and whether it
+// knows the method, back to the metrics middleware that runs outside of it.
+type routeHolder struct {
+	pattern string
+	method  string
+}
+
+func setRoutePattern(r *http.Request, pattern string) {
+	if h, ok := r.Context().Value(routeKey{}).(*routeHolder); ok {
+		h.pattern = pattern
+	}
+}
+
+// setRouteMethod marks the method of r as one the router has routes for.
+// Other methods are labelled "other", so that clients cannot create series.
+func setRouteMethod(r *http.Request) {
+	if h, ok := r.Context().Value(routeKey{}).(*routeHolder); ok {
+		h.method = r.Method
+	}
+}
+
+// routePattern returns the pattern matched for r, once the router has run.
+func routePattern(r *http.Request) string {
+	if h, ok := r.Context().Value(routeKey{}).(*routeHolder); ok {
+		return h.pattern
+	}
+	return "unmatched"
+}
+
+// InstrumentRequests counts requests and records their latency. Routes are
+// labelled by pattern, so /v2/users/me/cities/{id} is one series.
+func InstrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		holder := &routeHolder{pattern: "unmatched", method: "other"}
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeKey{}, holder)))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(holder.pattern, holder.method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(holder.pattern, holder.method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,177 @@
+package weatherservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
+	"github.com/ilyaytrewq/WeatherServiceAPI/logging"
+)
+
+// maxBodyBytes bounds every request body.
+const maxBodyBytes = 1 << 20
+
+type requestIDKey struct{}
+
+type userKey struct{}
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// RequestID attaches the caller's X-Request-ID, or a fresh one, to the
+// request context and echoes it in the response headers.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var b [8]byte
+			if _, err := rand.Read(b[:]); err != nil {
+				slog.Error("RequestID: rand error", "err", err)
+			}
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = logging.WithAttrs(ctx, slog.String("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// LogRequests logs every request with its outcome and duration.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"status", rec.status,
+			"duration", time.Since(start))
+	})
+}
+
+// Recover turns a panicking handler into a 500 response.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				slog.ErrorContext(r.Context(), "panic", "panic", p, "stack", string(debug.Stack()))
+				writeError(w, r, fmt.Errorf("panic: %v", p))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitBody caps request bodies at n bytes.
+func LimitBody(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// JSONResponses sets the default content type of every response.
+func JSONResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ValidateSpec rejects requests that do not conform to the OpenAPI document.
+func ValidateSpec(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkRequest(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// RequireUser authenticates the request with HTTP Basic credentials (email
+// and password) and stores the user in the request context.
+func (s *Service) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, password, ok := r.BasicAuth()
+		if !ok || email == "" || password == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="weather"`)
+			writeErrorStatus(w, r, http.StatusUnauthorized, api.Unauthorized, "authentication required")
+			return
+		}
+
+		var user UserData
+		var err error
+		if normalized, ok := normalizeEmail(email); !ok {
+			err = newError(ErrNotFound, "user not found", fmt.Errorf("RequireUser: malformed email %q", email))
+		} else {
+			user, err = s.authenticateUser(r.Context(), normalized, password)
+		}
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrWrongPassword) {
+			// Do not reveal which of the two credentials was wrong.
+			slog.InfoContext(r.Context(), "RequireUser: authentication failed", "err", err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="weather"`)
+			writeErrorStatus(w, r, http.StatusUnauthorized, api.Unauthorized, "invalid credentials")
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// userFrom returns the user stored by RequireUser.
+func userFrom(r *http.Request) UserData {
+	user, _ := r.Context().Value(userKey{}).(UserData)
+	return user
+}
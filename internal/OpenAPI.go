@@ -0,0 +1,52 @@
+package weatherservice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
+)
+
+var requestValidator = mustValidator()
+
+func mustValidator() *api.Validator {
+	v, err := api.NewValidator(api.Spec)
+	if err != nil {
+		log.Fatalf("OpenAPI: %v", err)
+	}
+	return v
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write(api.Spec)
+}
+
+// checkRequest validates r against the OpenAPI document and answers with an
+// error response if it does not conform. Paths missing from the document are
+// left to the handler.
+func checkRequest(w http.ResponseWriter, r *http.Request) bool {
+	err := requestValidator.ValidateRequest(r)
+
+	var methodErr *api.MethodError
+	var validationErr *api.ValidationError
+	var tooLargeErr *http.MaxBytesError
+	switch {
+	case err == nil, errors.Is(err, api.ErrNoRoute):
+		return true
+	case errors.As(err, &tooLargeErr):
+		writeErrorStatus(w, r, http.StatusRequestEntityTooLarge, api.PayloadTooLarge,
+			fmt.Sprintf("request body must be at most %d bytes", tooLargeErr.Limit))
+	case errors.As(err, &methodErr):
+		methodNotAllowed(w, r, methodErr.Allowed...)
+	case errors.As(err, &validationErr):
+		e := newError(ErrValidation, "invalid request", fmt.Errorf("checkRequest: %w", err))
+		e.Details = validationErr.Details
+		writeError(w, r, e)
+	default:
+		writeError(w, r, fmt.Errorf("checkRequest: %w", err))
+	}
+	return false
+}
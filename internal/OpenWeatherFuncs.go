@@ -1,24 +1,39 @@
 package weatherservice
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"strings"
-)
+	"net/url"
+	"time"
 
-const (
-	apiWeatherURL     = "https://pro.openweathermap.org/data/2.5/weather"
-	apiCoordinatesURL = "http://api.openweathermap.org/geo/1.0/direct"
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	"github.com/ilyaytrewq/WeatherServiceAPI/logging"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var (
-	apiKey = os.Getenv("API_WEATHER_KEY")
-)
+// OpenWeather is the WeatherProvider backed by the OpenWeather API.
+type OpenWeather struct {
+	apiKey            string
+	apiWeatherURL     string
+	apiCoordinatesURL string
+	client            *http.Client
+}
+
+// NewOpenWeather returns a provider with the credentials and endpoints of cfg.
+func NewOpenWeather(cfg config.OpenWeather) *OpenWeather {
+	return &OpenWeather{
+		apiKey:            cfg.APIKey,
+		apiWeatherURL:     cfg.WeatherURL,
+		apiCoordinatesURL: cfg.GeocodingURL,
+		client:            http.DefaultClient,
+	}
+}
 
 type weatherAPIResp struct {
 	Dt   int64 `json:"dt"`
@@ -33,36 +48,49 @@ type weatherAPIResp struct {
 	} `json:"wind"`
 }
 
-func GetCoordinates(cityName string) (CityType, error) {
-	url := fmt.Sprintf("%s?q=%s&limit=1&appid=%s", apiCoordinatesURL, cityName, apiKey)
-	log.Printf("GetCoordinates: URL=%s", strings.Replace(url, apiKey, "***", 1))
+func (o *OpenWeather) Coordinates(ctx context.Context, cityName string) (city CityType, err error) {
+	defer observeProvider("geocoding", time.Now(), &err)
+	ctx, span := startProviderSpan(ctx, "geocoding")
+	defer func() { endSpan(span, err) }()
+
+	query := url.Values{}
+	query.Set("q", cityName)
+	query.Set("limit", "1")
+	query.Set("appid", o.apiKey)
+	reqURL := o.apiCoordinatesURL + "?" + query.Encode()
+	slog.DebugContext(ctx, "Coordinates: request", "url", reqURL)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
-		log.Printf("GetCoordinates: request error: %v", err)
-		return CityType{}, fmt.Errorf("GetCoordinates: request error: %w", err)
+		return CityType{}, fmt.Errorf("Coordinates: new request: %w", err)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		err = redactURLError(err)
+		slog.WarnContext(ctx, "Coordinates: request error", "err", err)
+		return CityType{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("Coordinates: request error: %w", err))
 	}
 	defer resp.Body.Close()
 
-	log.Printf("GetCoordinates: status=%s", resp.Status)
+	slog.DebugContext(ctx, "Coordinates: response", "status", resp.Status)
 
 	if resp.StatusCode != http.StatusOK {
-		return CityType{}, errors.New("GetCoordinates: non-200 response from API")
+		return CityType{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("Coordinates: non-200 response from API: %s", resp.Status))
 	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return CityType{}, fmt.Errorf("GetCoordinates: read body error: %w", err)
+		return CityType{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("Coordinates: read body error: %w", err))
 	}
 
 	var cities []CityType
-	if err := json.Unmarshal(data, &cities); err != nil {
-		log.Printf("GetCoordinates: decode error: %v", err)
-		return CityType{}, fmt.Errorf("GetCoordinates: decode error: %w", err)
+	if err = json.Unmarshal(data, &cities); err != nil {
+		slog.WarnContext(ctx, "Coordinates: decode error", "err", err)
+		return CityType{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("Coordinates: decode error: %w", err))
 	}
 	if len(cities) == 0 {
-		log.Printf("GetCoordinates: no results for city %s", cityName)
-		return CityType{}, fmt.Errorf("GetCoordinates: no results for city %s", cityName)
+		slog.InfoContext(ctx, "Coordinates: no results", "city", cityName)
+		return CityType{}, newError(ErrValidation, fmt.Sprintf("unknown city %s", cityName), nil)
 	}
 
 	if len(data) > 0 {
@@ -70,32 +98,41 @@ func GetCoordinates(cityName string) (CityType, error) {
 		if len(sample) > 200 {
 			sample = sample[:200] + "..."
 		}
-		log.Printf("GetCoordinates: response sample=%s", sample)
+		slog.DebugContext(ctx, "Coordinates: response sample", "sample", sample)
 	}
 
 	return cities[0], nil
 }
 
-func GetWeather(city CityType) (weatherAPIResp, error) {
-	url := fmt.Sprintf("%s?lat=%f&lon=%f&appid=%s&units=metric", apiWeatherURL, city.Lat, city.Lon, apiKey)
-	log.Printf("GetWeather: URL=%s", url)
+func (o *OpenWeather) CurrentWeather(ctx context.Context, city CityType) (_ WeatherSample, err error) {
+	defer observeProvider("weather", time.Now(), &err)
+	ctx, span := startProviderSpan(ctx, "weather")
+	defer func() { endSpan(span, err) }()
 
-	resp, err := http.Get(url)
+	url := fmt.Sprintf("%s?lat=%f&lon=%f&appid=%s&units=metric", o.apiWeatherURL, city.Lat, city.Lon, o.apiKey)
+	slog.DebugContext(ctx, "CurrentWeather: request", "url", url)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		log.Printf("GetWeather: request error: %v", err)
-		return weatherAPIResp{}, fmt.Errorf("GetWeather: request error: %w", err)
+		return WeatherSample{}, fmt.Errorf("CurrentWeather: new request: %w", err)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		err = redactURLError(err)
+		slog.WarnContext(ctx, "CurrentWeather: request error", "err", err)
+		return WeatherSample{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("CurrentWeather: request error: %w", err))
 	}
 	defer resp.Body.Close()
 
-	log.Printf("GetWeather: status=%s", resp.Status)
+	slog.DebugContext(ctx, "CurrentWeather: response", "status", resp.Status)
 
 	if resp.StatusCode != http.StatusOK {
-		return weatherAPIResp{}, errors.New("GetWeather: non-200 response from API")
+		return WeatherSample{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("CurrentWeather: non-200 response from API: %s", resp.Status))
 	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return weatherAPIResp{}, fmt.Errorf("GetWeather: read body error: %w", err)
+		return WeatherSample{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("CurrentWeather: read body error: %w", err))
 	}
 
 	if len(data) > 0 {
@@ -103,14 +140,66 @@ func GetWeather(city CityType) (weatherAPIResp, error) {
 		if len(sample) > 200 {
 			sample = sample[:200] + "..."
 		}
-		log.Printf("GetWeather: response sample=%s", sample)
+		slog.DebugContext(ctx, "CurrentWeather: response sample", "sample", sample)
 	}
 
 	var weatherResp weatherAPIResp
 	if err := json.Unmarshal(data, &weatherResp); err != nil {
-		log.Printf("GetWeather: decode error: %v", err)
-		return weatherAPIResp{}, fmt.Errorf("GetWeather: decode error: %w", err)
+		slog.WarnContext(ctx, "CurrentWeather: decode error", "err", err)
+		return WeatherSample{}, newError(ErrUnavailable, "weather provider unavailable", fmt.Errorf("CurrentWeather: decode error: %w", err))
 	}
 
-	return weatherResp, nil
+	return WeatherSample{
+		Time:      time.Unix(weatherResp.Dt, 0),
+		City:      city.Name,
+		Temp:      weatherResp.Main.Temp,
+		FeelsLike: weatherResp.Main.FeelsLike,
+		Pressure:  weatherResp.Main.Pressure,
+		WindSpeed: weatherResp.Wind.Speed,
+		WindDeg:   weatherResp.Wind.Deg,
+	}, nil
+}
+
+// Ping reports whether the API answers at all. Any HTTP response counts;
+// only transport errors and 5xx are failures.
+func (o *OpenWeather) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, o.apiCoordinatesURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return redactURLError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// observeProvider records the latency and outcome of an OpenWeather call. An
+// unknown city is a successful call as far as the provider is concerned.
+func observeProvider(endpoint string, start time.Time, errp *error) {
+	providerDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	result := "ok"
+	if *errp != nil && !errors.Is(*errp, ErrValidation) {
+		result = "error"
+	}
+	providerRequests.WithLabelValues(endpoint, result).Inc()
+}
+
+func startProviderSpan(ctx context.Context, endpoint string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "openweather "+endpoint, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.ServerAddress("api.openweathermap.org")))
+}
+
+// redactURLError masks the API key in the URL that net/http includes in its
+// errors, which end up in logs and spans.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = logging.Redact(urlErr.URL)
+	}
+	return err
 }
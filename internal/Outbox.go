@@ -0,0 +1,99 @@
+package weatherservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Emails are not published by the request that causes them. The user store
+// queues them in its outbox in the same transaction as the change, and the
+// relay publishes them afterwards: a committed change always gets its email,
+// even if the broker is down at the time, and a rolled back one never does.
+
+// newEmailKey returns a fresh idempotency key. It is fixed when the email is
+// queued, so that every publication of the email carries the same key and
+// smtp_service sends it once even if the relay publishes it again.
+func newEmailKey() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		slog.Error("newEmailKey: rand error", "err", err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// outboxRetention is how long sent emails are kept in the outbox.
+const outboxRetention = 7 * 24 * time.Hour
+
+// relayOutbox publishes queued emails until the outbox is drained or the
+// publisher fails; whatever is left is retried on the next run. A run may
+// take at most timeout.
+func (s *Service) relayOutbox(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		sent, err := s.users.RelayEmails(ctx, s.outboxBatch, func(ctx context.Context, e OutboxEmail) error {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(e.Trace))
+			return s.publishEmail(ctx, e.Task)
+		})
+		if sent > 0 {
+			slog.InfoContext(ctx, "relayOutbox: emails published", "count", sent)
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "relayOutbox: relay stopped, will retry", "err", err)
+			return
+		}
+		if sent < s.outboxBatch {
+			return
+		}
+	}
+}
+
+// wakeOutbox asks the relay to publish freshly queued emails now rather than
+// on its next tick.
+func (s *Service) wakeOutbox() {
+	if s.outbox != nil {
+		s.outbox.Wake()
+	}
+}
+
+// traceContext returns the propagation headers of the span in ctx, which
+// relayOutbox restores when it publishes the email.
+func traceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// encodeOutboxEmail serializes task and the trace context of ctx for the
+// outbox.
+func encodeOutboxEmail(ctx context.Context, task EmailTask) (payload, trace []byte, err error) {
+	payload, err = json.Marshal(task)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encodeOutboxEmail: payload: %w", err)
+	}
+	trace, err = json.Marshal(traceContext(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("encodeOutboxEmail: trace: %w", err)
+	}
+	return payload, trace, nil
+}
+
+func decodeOutboxEmail(id int64, payload, trace []byte) (OutboxEmail, error) {
+	e := OutboxEmail{ID: id}
+	if err := json.Unmarshal(payload, &e.Task); err != nil {
+		return OutboxEmail{}, fmt.Errorf("decodeOutboxEmail: email %d: %w", id, err)
+	}
+	if err := json.Unmarshal(trace, &e.Trace); err != nil {
+		return OutboxEmail{}, fmt.Errorf("decodeOutboxEmail: email %d: trace: %w", id, err)
+	}
+	return e, nil
+}
@@ -0,0 +1,452 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	"github.com/lib/pq"
+)
+
+const createUsersTable = `
+	CREATE TABLE IF NOT EXISTS users (
+		email VARCHAR(255) NOT NULL PRIMARY KEY,
+		password VARCHAR(255) NOT NULL,
+		cities TEXT[] DEFAULT '{}'
+	);
+`
+
+// Emails are stored lower-cased since user-facing input is normalized. Rows
+// written before that are lower-cased in place, one per address; accounts
+// that differ from another only in case are left for an operator to merge,
+// since the unique index below cannot be built until they are gone.
+const lowercaseUserEmails = `
+	UPDATE users SET email = lower(users.email)
+	FROM (
+		SELECT DISTINCT ON (lower(email)) email
+		FROM users u
+		WHERE email <> lower(email)
+			AND NOT EXISTS (SELECT 1 FROM users l WHERE l.email = lower(u.email))
+		ORDER BY lower(email), email
+	) keep
+	WHERE users.email = keep.email;
+`
+
+const countCaseDuplicates = `
+	SELECT count(*) FROM users WHERE email <> lower(email);
+`
+
+const createUsersEmailIndex = `
+	CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower ON users (lower(email));
+`
+
+const createLoginFailuresTable = `
+	CREATE TABLE IF NOT EXISTS login_failures (
+		email VARCHAR(255) NOT NULL PRIMARY KEY,
+		failures INT NOT NULL DEFAULT 0,
+		last_failure TIMESTAMPTZ NOT NULL DEFAULT now(),
+		locked_until TIMESTAMPTZ
+	);
+`
+
+const createOutboxTable = `
+	CREATE TABLE IF NOT EXISTS outbox (
+		id BIGSERIAL PRIMARY KEY,
+		payload JSONB NOT NULL,
+		trace_context JSONB NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		sent_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (id) WHERE sent_at IS NULL;
+`
+
+// PostgresStore is the UserStore backed by Postgres.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to Postgres and creates the tables.
+func NewPostgresStore(cfg config.Postgres) (*PostgresStore, error) {
+	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.DB)
+
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Postgres: %w", err)
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping Postgres: %w", err)
+	}
+
+	if _, err := db.Exec(createUsersTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create users table: %w", err)
+	}
+
+	if err := lowercaseEmails(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec(createLoginFailuresTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create login_failures table: %w", err)
+	}
+
+	if _, err := db.Exec(createOutboxTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create outbox table: %w", err)
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+// lowercaseEmails migrates the users table to lower-cased emails and makes
+// them unique regardless of case.
+func lowercaseEmails(db *sql.DB) error {
+	res, err := db.Exec(lowercaseUserEmails)
+	if err != nil {
+		return fmt.Errorf("failed to lower-case user emails: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("NewPostgresStore: lower-cased user emails", "count", n)
+	}
+
+	var left int
+	if err := db.QueryRow(countCaseDuplicates).Scan(&left); err != nil {
+		return fmt.Errorf("failed to count user emails: %w", err)
+	}
+	if left > 0 {
+		return fmt.Errorf("%d users have an email that differs from another user's only in case; merge or delete them (SELECT email FROM users WHERE email <> lower(email)) and restart", left)
+	}
+
+	if _, err := db.Exec(createUsersEmailIndex); err != nil {
+		return fmt.Errorf("failed to create users email index: %w", err)
+	}
+	return nil
+}
+
+func (p *PostgresStore) Ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+func (p *PostgresStore) Close() error {
+	if err := p.db.Close(); err != nil {
+		return fmt.Errorf("PostgresStore.Close: %w", err)
+	}
+	return nil
+}
+
+func (p *PostgresStore) GetUser(ctx context.Context, email string) (StoredUser, error) {
+	user := StoredUser{Email: email}
+	ctx, span := startPostgresSpan(ctx, "SELECT users")
+	err := p.db.QueryRowContext(ctx, "SELECT password, cities FROM users WHERE email=$1", email).Scan(&user.PasswordHash, pq.Array(&user.Cities))
+	endSpan(span, err)
+	if err == sql.ErrNoRows {
+		return StoredUser{}, newError(ErrNotFound, "user not found", nil)
+	}
+	if err != nil {
+		return StoredUser{}, unavailable(fmt.Errorf("GetUser: select error: %w", err))
+	}
+	return user, nil
+}
+
+// CreateUser inserts the user row in a transaction that is committed only
+// after commit succeeds.
+func (p *PostgresStore) CreateUser(ctx context.Context, user StoredUser, commit func(context.Context) error) error {
+	var exists bool
+	selectCtx, span := startPostgresSpan(ctx, "SELECT users")
+	err := p.db.QueryRowContext(selectCtx, "SELECT EXISTS (SELECT 1 FROM users WHERE email=$1)", user.Email).Scan(&exists)
+	endSpan(span, err)
+	if err != nil {
+		return unavailable(fmt.Errorf("CreateUser: select error: %w", err))
+	}
+	if exists {
+		return newError(ErrConflict, "user already exists", nil)
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return unavailable(fmt.Errorf("CreateUser: begin error: %w", err))
+	}
+	defer tx.Rollback()
+
+	insertCtx, span := startPostgresSpan(ctx, "INSERT users")
+	_, err = tx.ExecContext(insertCtx, `
+		INSERT INTO users (email, password, cities)
+		VALUES ($1, $2, $3);
+	`, user.Email, user.PasswordHash, pq.Array(user.Cities))
+	endSpan(span, err)
+	if isUniqueViolation(err) {
+		// Lost a race with a concurrent registration of the same email.
+		return newError(ErrConflict, "user already exists", nil)
+	}
+	if err != nil {
+		return unavailable(fmt.Errorf("CreateUser: insert error: %w", err))
+	}
+
+	if err := commit(ctx); err != nil {
+		return fmt.Errorf("CreateUser: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return unavailable(fmt.Errorf("CreateUser: commit error: %w", err))
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func (p *PostgresStore) SetCities(ctx context.Context, email string, cities []string) error {
+	ctx, span := startPostgresSpan(ctx, "UPDATE users")
+	_, err := p.db.ExecContext(ctx, "UPDATE users SET cities = $1 WHERE email = $2", pq.Array(cities), email)
+	endSpan(span, err)
+	if err != nil {
+		return unavailable(fmt.Errorf("SetCities: update error: %w", err))
+	}
+	return nil
+}
+
+func (p *PostgresStore) AddCity(ctx context.Context, email, city string) error {
+	ctx, span := startPostgresSpan(ctx, "UPDATE users")
+	_, err := p.db.ExecContext(ctx, `
+		UPDATE users SET cities = array_append(cities, $1::text)
+		WHERE email = $2 AND NOT ($1::text = ANY(cities));
+	`, city, email)
+	endSpan(span, err)
+	if err != nil {
+		return unavailable(fmt.Errorf("AddCity: update error: %w", err))
+	}
+	return nil
+}
+
+func (p *PostgresStore) RemoveCity(ctx context.Context, email, city string) (bool, error) {
+	ctx, span := startPostgresSpan(ctx, "UPDATE users")
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE users SET cities = array_remove(cities, $1::text)
+		WHERE email = $2 AND $1::text = ANY(cities);
+	`, city, email)
+	endSpan(span, err)
+	if err != nil {
+		return false, unavailable(fmt.Errorf("RemoveCity: update error: %w", err))
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("RemoveCity: rows affected: %w", err)
+	}
+	return n > 0, nil
+}
+
+// UpdateUser changes both columns in one statement; a NULL parameter keeps
+// the column as it is.
+func (p *PostgresStore) UpdateUser(ctx context.Context, email string, passwordHash *string, cities []string) error {
+	ctx, span := startPostgresSpan(ctx, "UPDATE users")
+	_, err := p.db.ExecContext(ctx, `
+		UPDATE users SET password = COALESCE($1, password), cities = COALESCE($2, cities)
+		WHERE email = $3
+	`, passwordHash, pq.Array(cities), email)
+	endSpan(span, err)
+	if err != nil {
+		return unavailable(fmt.Errorf("UpdateUser: update error: %w", err))
+	}
+	return nil
+}
+
+func (p *PostgresStore) DeleteUser(ctx context.Context, email string) error {
+	ctx, span := startPostgresSpan(ctx, "DELETE users")
+	_, err := p.db.ExecContext(ctx, "DELETE FROM users WHERE email=$1", email)
+	endSpan(span, err)
+	if err != nil {
+		return unavailable(fmt.Errorf("DeleteUser: delete error: %w", err))
+	}
+	return nil
+}
+
+func (p *PostgresStore) LockedUntil(ctx context.Context, email string) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	ctx, span := startPostgresSpan(ctx, "SELECT login_failures")
+	err := p.db.QueryRowContext(ctx, "SELECT locked_until FROM login_failures WHERE email=$1", email).Scan(&lockedUntil)
+	endSpan(span, err)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, unavailable(fmt.Errorf("LockedUntil: select error: %w", err))
+	}
+	return lockedUntil.Time, nil
+}
+
+func (p *PostgresStore) RecordLoginFailure(ctx context.Context, email string, window time.Duration) (int, error) {
+	var failures int
+	ctx, span := startPostgresSpan(ctx, "INSERT login_failures")
+	err := p.db.QueryRowContext(ctx, `
+		INSERT INTO login_failures (email, failures, last_failure)
+		VALUES ($1, 1, now())
+		ON CONFLICT (email) DO UPDATE SET
+			failures = CASE
+				WHEN login_failures.last_failure < now() - $2 * interval '1 second' THEN 1
+				ELSE login_failures.failures + 1
+			END,
+			last_failure = now()
+		RETURNING failures;
+	`, email, window.Seconds()).Scan(&failures)
+	endSpan(span, err)
+	if err != nil {
+		return 0, fmt.Errorf("RecordLoginFailure: upsert error: %w", err)
+	}
+	return failures, nil
+}
+
+func (p *PostgresStore) LockUser(ctx context.Context, email string, until time.Time, notice EmailTask) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("LockUser: begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	lockCtx, span := startPostgresSpan(ctx, "UPDATE login_failures")
+	_, err = tx.ExecContext(lockCtx, "UPDATE login_failures SET locked_until = $1 WHERE email = $2", until, email)
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("LockUser: update error: %w", err)
+	}
+
+	if err := enqueueEmail(ctx, tx, notice); err != nil {
+		return fmt.Errorf("LockUser: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("LockUser: commit error: %w", err)
+	}
+	return nil
+}
+
+// enqueueEmail queues task in the outbox as part of tx.
+func enqueueEmail(ctx context.Context, tx *sql.Tx, task EmailTask) error {
+	payload, trace, err := encodeOutboxEmail(ctx, task)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startPostgresSpan(ctx, "INSERT outbox")
+	_, err = tx.ExecContext(ctx, "INSERT INTO outbox (payload, trace_context) VALUES ($1, $2)", payload, trace)
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("enqueueEmail: insert error: %w", err)
+	}
+	return nil
+}
+
+// RelayEmails locks the pending rows it takes with SKIP LOCKED, so that
+// several API instances can relay at once, and prunes emails sent more than
+// outboxRetention ago.
+func (p *PostgresStore) RelayEmails(ctx context.Context, limit int, publish func(context.Context, OutboxEmail) error) (int, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("RelayEmails: begin error: %w", err)
+	}
+	defer tx.Rollback()
+
+	pending, err := selectPendingEmails(ctx, tx, limit)
+	if err != nil {
+		return 0, fmt.Errorf("RelayEmails: %w", err)
+	}
+
+	var sent []int64
+	var publishErr error
+	for _, row := range pending {
+		e, err := decodeOutboxEmail(row.id, row.payload, row.trace)
+		if err != nil {
+			// Retrying would not help and would block the emails behind it.
+			slog.ErrorContext(ctx, "RelayEmails: dropping undecodable email", "err", err)
+			sent = append(sent, row.id)
+			continue
+		}
+		if publishErr = publish(ctx, e); publishErr != nil {
+			publishErr = fmt.Errorf("RelayEmails: publish email %d: %w", e.ID, publishErr)
+			break
+		}
+		sent = append(sent, e.ID)
+	}
+
+	if len(sent) > 0 {
+		markCtx, span := startPostgresSpan(ctx, "UPDATE outbox")
+		_, err = tx.ExecContext(markCtx, "UPDATE outbox SET sent_at = now() WHERE id = ANY($1)", pq.Array(sent))
+		endSpan(span, err)
+		if err != nil {
+			return 0, fmt.Errorf("RelayEmails: mark sent: %w", err)
+		}
+	}
+
+	pruneCtx, span := startPostgresSpan(ctx, "DELETE outbox")
+	_, err = tx.ExecContext(pruneCtx, "DELETE FROM outbox WHERE sent_at < now() - $1 * interval '1 second'", outboxRetention.Seconds())
+	endSpan(span, err)
+	if err != nil {
+		return 0, fmt.Errorf("RelayEmails: prune: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("RelayEmails: commit error: %w", err)
+	}
+	return len(sent), publishErr
+}
+
+type outboxRow struct {
+	id             int64
+	payload, trace []byte
+}
+
+func selectPendingEmails(ctx context.Context, tx *sql.Tx, limit int) (_ []outboxRow, err error) {
+	ctx, span := startPostgresSpan(ctx, "SELECT outbox")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, payload, trace_context FROM outbox
+		WHERE sent_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED;
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select pending: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.payload, &row.trace); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		pending = append(pending, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows: %w", err)
+	}
+	return pending, nil
+}
+
+func (p *PostgresStore) ClearLoginFailures(ctx context.Context, email string) error {
+	ctx, span := startPostgresSpan(ctx, "DELETE login_failures")
+	_, err := p.db.ExecContext(ctx, "DELETE FROM login_failures WHERE email=$1", email)
+	endSpan(span, err)
+	if err != nil {
+		return fmt.Errorf("ClearLoginFailures: delete error: %w", err)
+	}
+	return nil
+}
+
+// unavailable marks a failed Postgres call so that it is reported as 503.
+func unavailable(err error) error {
+	return newError(ErrUnavailable, "database unavailable", err)
+}
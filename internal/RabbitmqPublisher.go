@@ -3,45 +3,123 @@ package weatherservice
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	RabbitConn    *amqp.Connection
-	RabbitChannel *amqp.Channel
 	EmailExchange = "email_exchange"
 	EmailQueue    = "email_queue"
 )
 
+// EmailTask asks smtp_service to send the email of kind Type to To.
+// smtp_service renders it from its templates for Type in Locale, or English,
+// filling them in from Meta. Key identifies the email: smtp_service sends
+// each key once, however often the task is delivered.
 type EmailTask struct {
-	To      string                 `json:"to"`
-	Subject string                 `json:"subject"`
-	Body    string                 `json:"body"`
-	Type    string                 `json:"type,omitempty"`
-	Meta    map[string]interface{} `json:"meta,omitempty"`
+	Key    string                 `json:"key,omitempty"`
+	To     string                 `json:"to"`
+	Type   string                 `json:"type"`
+	Locale string                 `json:"locale,omitempty"`
+	Meta   map[string]interface{} `json:"meta,omitempty"`
 }
 
-func InitRabbit() error {
-	url := os.Getenv("RABBITMQ_URL") 
-	if url == "" {
-		return fmt.Errorf("RABBITMQ_URL env not set")
+// Reconnection backoff: the first retry comes after reconnectMinDelay and
+// each failed attempt doubles the delay up to reconnectMaxDelay.
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// RabbitPublisher is the Publisher that sends email tasks to RabbitMQ. It
+// reconnects on its own when the connection or channel is lost; until then
+// Publish fails and the outbox keeps the emails. Every publish is mandatory
+// and waits for the broker's confirm, so a nil error means the task is in
+// email_queue. It is safe for concurrent use.
+type RabbitPublisher struct {
+	url string
+
+	// mu guards the connection and serializes publishes, since an amqp
+	// channel is not safe for concurrent use. conn and ch are nil while
+	// reconnecting.
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	ch      *amqp.Channel
+	returns chan amqp.Return
+	seq     uint64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewRabbitPublisher connects to RabbitMQ and declares the email exchange
+// and queue. Later connection losses are recovered in the background.
+func NewRabbitPublisher(cfg config.RabbitMQ) (*RabbitPublisher, error) {
+	p := &RabbitPublisher{
+		url:     cfg.URL,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	closed, err := p.connect()
+	if err != nil {
+		return nil, fmt.Errorf("NewRabbitPublisher: %w", err)
 	}
+	go p.watch(closed)
+
+	slog.Info("NewRabbitPublisher: connected")
+	return p, nil
+}
 
-	conn, err := amqp.Dial(url)
+// lost fires when the connection or the channel of a connect goes away.
+// amqp closes each notification channel on shutdown, so they are separate.
+type lost struct {
+	conn, ch chan *amqp.Error
+}
+
+// connect dials RabbitMQ, declares the topology and puts a fresh channel in
+// confirm mode.
+func (p *RabbitPublisher) connect() (lost, error) {
+	conn, err := amqp.Dial(p.url)
 	if err != nil {
-		return fmt.Errorf("InitRabbit: dial: %w", err)
+		return lost{}, fmt.Errorf("dial: %w", err)
 	}
 	ch, err := conn.Channel()
 	if err != nil {
 		conn.Close()
-		return fmt.Errorf("InitRabbit: channel: %w", err)
+		return lost{}, fmt.Errorf("channel: %w", err)
+	}
+	if err := declareEmailQueue(ch); err != nil {
+		conn.Close()
+		return lost{}, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return lost{}, fmt.Errorf("confirm mode: %w", err)
+	}
+
+	closed := lost{
+		conn: conn.NotifyClose(make(chan *amqp.Error, 1)),
+		ch:   ch.NotifyClose(make(chan *amqp.Error, 1)),
 	}
 
+	p.mu.Lock()
+	p.conn, p.ch = conn, ch
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 16))
+	p.mu.Unlock()
+	return closed, nil
+}
+
+func declareEmailQueue(ch *amqp.Channel) error {
 	if err := ch.ExchangeDeclare(
 		EmailExchange, // name
 		"direct",      // type
@@ -51,12 +129,10 @@ func InitRabbit() error {
 		false,         // no-wait
 		nil,           // args
 	); err != nil {
-		ch.Close()
-		conn.Close()
-		return fmt.Errorf("InitRabbit: exchange declare: %w", err)
+		return fmt.Errorf("exchange declare: %w", err)
 	}
 
-	_, err = ch.QueueDeclare(
+	_, err := ch.QueueDeclare(
 		EmailQueue, // name
 		true,       // durable
 		false,      // delete when unused
@@ -65,46 +141,164 @@ func InitRabbit() error {
 		nil,        // args
 	)
 	if err != nil {
-		ch.Close()
-		conn.Close()
-		return fmt.Errorf("InitRabbit: queue declare: %w", err)
+		return fmt.Errorf("queue declare: %w", err)
 	}
 
 	if err := ch.QueueBind(EmailQueue, "send_email", EmailExchange, false, nil); err != nil {
-		ch.Close()
-		conn.Close()
-		return fmt.Errorf("InitRabbit: queue bind: %w", err)
+		return fmt.Errorf("queue bind: %w", err)
 	}
-
-	RabbitConn = conn
-	RabbitChannel = ch
-	log.Println("InitRabbit: connected")
 	return nil
 }
 
-func PublishEmailTask(ctx context.Context, task EmailTask) error {
-	if RabbitChannel == nil {
-		return fmt.Errorf("rabbit channel not initialized")
+// watch reconnects whenever the connection is lost, until Close is called.
+func (p *RabbitPublisher) watch(closed lost) {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.done:
+			return
+		case err := <-closed.conn:
+			slog.Warn("RabbitPublisher: connection lost, reconnecting", "err", err)
+		case err := <-closed.ch:
+			slog.Warn("RabbitPublisher: channel closed, reconnecting", "err", err)
+		}
+		p.disconnect()
+
+		var ok bool
+		if closed, ok = p.reconnect(); !ok {
+			return
+		}
+	}
+}
+
+// reconnect retries connect with backoff. It reports false if Close was
+// called first.
+func (p *RabbitPublisher) reconnect() (lost, bool) {
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-p.done:
+			return lost{}, false
+		case <-time.After(delay):
+		}
+
+		closed, err := p.connect()
+		if err == nil {
+			slog.Info("RabbitPublisher: reconnected", "attempt", attempt)
+			return closed, true
+		}
+		delay = min(2*delay, reconnectMaxDelay)
+		slog.Warn("RabbitPublisher: reconnect failed", "attempt", attempt, "retry_in", delay, "err", err)
 	}
+}
+
+// disconnect drops the current connection, closing it if it is still open.
+func (p *RabbitPublisher) disconnect() {
+	p.mu.Lock()
+	conn := p.conn
+	p.conn, p.ch, p.returns = nil, nil, nil
+	p.mu.Unlock()
+
+	if conn != nil && !conn.IsClosed() {
+		conn.Close()
+	}
+}
+
+func (p *RabbitPublisher) Publish(ctx context.Context, task EmailTask) (err error) {
+	ctx, span := tracer.Start(ctx, EmailExchange+" publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		semconv.MessagingSystemRabbitmq,
+		semconv.MessagingOperationTypePublish,
+		semconv.MessagingDestinationName(EmailExchange),
+		semconv.MessagingRabbitmqDestinationRoutingKey("send_email"),
+	))
+	defer func() { endSpan(span, err) }()
+
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, amqpHeaders(headers))
+
 	body, err := json.Marshal(task)
 	if err != nil {
-		return fmt.Errorf("PublishEmailTask: marshal: %w", err)
+		return fmt.Errorf("Publish: marshal: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == nil {
+		return errors.New("Publish: not connected to RabbitMQ")
+	}
+
+	// Returns of earlier publishes that gave up waiting are stale.
+	for len(p.returns) > 0 {
+		<-p.returns
 	}
+	p.seq++
+	messageID := strconv.FormatUint(p.seq, 10)
 
-	err = RabbitChannel.PublishWithContext(ctx,
+	confirm, err := p.ch.PublishWithDeferredConfirmWithContext(ctx,
 		EmailExchange, // exchange
 		"send_email",  // routing key
-		false,         // mandatory
+		true,          // mandatory
 		false,         // immediate
 		amqp.Publishing{
 			ContentType:  "application/json",
+			Headers:      headers,
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
 			Timestamp:    time.Now(),
+			MessageId:    messageID,
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("PublishEmailTask: publish: %w", err)
+		return fmt.Errorf("Publish: publish: %w", err)
+	}
+
+	acked := make(chan bool, 1)
+	go func() { acked <- confirm.Wait() }()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("Publish: waiting for confirm: %w", ctx.Err())
+	case ok := <-acked:
+		if !ok {
+			return errors.New("Publish: nacked by broker")
+		}
+	}
+
+	// The broker sends basic.return before the ack of an unroutable
+	// message, so by now it is already buffered.
+	for len(p.returns) > 0 {
+		if r := <-p.returns; r.MessageId == messageID {
+			return fmt.Errorf("Publish: returned by broker: %s", r.ReplyText)
+		}
+	}
+	return nil
+}
+
+func (p *RabbitPublisher) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.conn == nil:
+		return errors.New("reconnecting")
+	case p.conn.IsClosed():
+		return errors.New("connection closed")
+	case p.ch.IsClosed():
+		return errors.New("channel closed")
+	}
+	return nil
+}
+
+// Close stops reconnecting and closes the connection.
+func (p *RabbitPublisher) Close() error {
+	close(p.done)
+	<-p.stopped
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	if err := p.conn.Close(); err != nil {
+		return fmt.Errorf("RabbitPublisher.Close: %w", err)
 	}
 	return nil
 }
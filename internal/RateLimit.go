@@ -0,0 +1,113 @@
+package weatherservice
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Every client IP may send ipRate requests per second with bursts of ipBurst.
+	ipRate  = 5
+	ipBurst = 20
+
+	// Every email may be used for emailBurst logins, then emailRate per second.
+	emailRate  = 1
+	emailBurst = 10
+
+	// Buckets unused for this long are forgotten.
+	bucketIdleTTL = 10 * time.Minute
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets keyed by an arbitrary string.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the bucket of key. When the bucket is empty it
+// reports how long the caller has to wait for the next token.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketIdleTTL {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > bucketIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func tooManyRequests(retryAfter time.Duration, err error) *Error {
+	e := newError(ErrTooManyRequests, "too many requests, retry later", err)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+// LimitRate applies the per-IP token bucket to the API routes.
+func (s *Service) LimitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, wait := s.ipLimiter.allow(ip); !ok {
+			writeError(w, r, tooManyRequests(wait, fmt.Errorf("LimitRate: ip %s over limit", ip)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP is the address of the peer. X-Forwarded-For is ignored on purpose:
+// the service is exposed directly and the header is trivially spoofed.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
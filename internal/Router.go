@@ -0,0 +1,128 @@
+package weatherservice
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h so that the first middleware is the outermost one.
+func Chain(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.Handler
+}
+
+// Router dispatches on method and path. Patterns are slash-separated and a
+// segment written as {name} matches any single segment; its unescaped value
+// is available through r.PathValue(name).
+type Router struct {
+	routes     []route
+	methods    map[string]bool
+	middleware []Middleware
+	handler    http.Handler
+}
+
+// NewRouter returns a router that runs mw around every request, including
+// the ones that end in 404 or 405.
+func NewRouter(mw ...Middleware) *Router {
+	rt := &Router{methods: make(map[string]bool), middleware: mw}
+	rt.handler = Chain(http.HandlerFunc(rt.dispatch), mw...)
+	return rt
+}
+
+// Handle registers h for method and pattern, wrapped in the route-specific mw.
+func (rt *Router) Handle(method, pattern string, h http.Handler, mw ...Middleware) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		pattern:  pattern,
+		segments: splitPath(pattern),
+		handler:  Chain(h, mw...),
+	})
+	rt.methods[method] = true
+}
+
+func (rt *Router) HandleFunc(method, pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(method, pattern, h, mw...)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler.ServeHTTP(w, r)
+}
+
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	if rt.methods[r.Method] {
+		setRouteMethod(r)
+	}
+	segments := splitPath(r.URL.EscapedPath())
+
+	var allowed []string
+	for _, route := range rt.routes {
+		params, ok := matchSegments(route.segments, segments)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		for name, value := range params {
+			r.SetPathValue(name, value)
+		}
+		setRoutePattern(r, route.pattern)
+		route.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		methodNotAllowed(w, r, allowed...)
+		return
+	}
+	writeErrorStatus(w, r, http.StatusNotFound, api.NotFound, "not found")
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func matchSegments(pattern, path []string) (map[string]string, bool) {
+	if len(pattern) != len(path) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range pattern {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			value, err := url.PathUnescape(path[i])
+			if err != nil || value == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg[1:len(seg)-1]] = value
+			continue
+		}
+		if seg != path[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeErrorStatus(w, r, http.StatusMethodNotAllowed, api.MethodNotAllowed, "method not allowed")
+}
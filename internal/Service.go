@@ -0,0 +1,194 @@
+package weatherservice
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// UserStore persists accounts, failed login attempts and the email outbox.
+// Methods return errors matching ErrNotFound or ErrConflict where documented
+// and plain errors when the store itself fails.
+type UserStore interface {
+	// GetUser returns ErrNotFound if there is no user with that email.
+	GetUser(ctx context.Context, email string) (StoredUser, error)
+	// CreateUser inserts user and calls commit before the insert becomes
+	// visible; if commit fails the user is not stored. Whatever commit wrote
+	// stays if the insert fails afterwards. It returns ErrConflict if
+	// the email is taken.
+	CreateUser(ctx context.Context, user StoredUser, commit func(context.Context) error) error
+	SetCities(ctx context.Context, email string, cities []string) error
+	// AddCity appends city unless the user already has it.
+	AddCity(ctx context.Context, email, city string) error
+	// RemoveCity reports whether the user had city.
+	RemoveCity(ctx context.Context, email, city string) (bool, error)
+	// UpdateUser sets the password hash and the cities that are not nil,
+	// both or neither.
+	UpdateUser(ctx context.Context, email string, passwordHash *string, cities []string) error
+	DeleteUser(ctx context.Context, email string) error
+
+	// LockedUntil returns the end of the active lockout, or the zero time.
+	LockedUntil(ctx context.Context, email string) (time.Time, error)
+	// RecordLoginFailure counts a failure and returns the number of failures
+	// within window, this one included.
+	RecordLoginFailure(ctx context.Context, email string, window time.Duration) (int, error)
+	// LockUser locks the account and queues notice in the outbox, atomically.
+	LockUser(ctx context.Context, email string, until time.Time, notice EmailTask) error
+	ClearLoginFailures(ctx context.Context, email string) error
+
+	// RelayEmails hands up to limit queued emails, oldest first, to publish
+	// and marks the ones it accepted as sent. It stops at the first publish
+	// error and returns how many were sent. Concurrent callers get disjoint
+	// emails.
+	RelayEmails(ctx context.Context, limit int, publish func(context.Context, OutboxEmail) error) (int, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// StoredUser is a user as persisted, with the bcrypt hash of the password.
+type StoredUser struct {
+	Email        string
+	PasswordHash string
+	Cities       []string
+}
+
+// OutboxEmail is an email task queued in the outbox. Trace carries the trace
+// context of the change that queued it.
+type OutboxEmail struct {
+	ID    int64
+	Task  EmailTask
+	Trace map[string]string
+}
+
+// MetricsStore keeps the known cities and the collected weather samples.
+type MetricsStore interface {
+	LoadCities(ctx context.Context) (map[string]CityType, error)
+	InsertCities(ctx context.Context, cities map[string]CityType) error
+	InsertWeather(ctx context.Context, samples []WeatherSample) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// WeatherSample is the current weather in one city, as stored in
+// weather_metrics.
+type WeatherSample struct {
+	Time      time.Time
+	City      string
+	Temp      float32
+	FeelsLike float32
+	Pressure  int16
+	WindSpeed float32
+	WindDeg   int16
+}
+
+// CityRegistry is the in-process set of cities weather is collected for.
+type CityRegistry interface {
+	Get(name string) (CityType, bool)
+	Len() int
+	Snapshot() map[string]CityType
+	Resolve(names []string, geocode func(string) (CityType, error)) (map[string]CityType, error)
+	Add(ctx context.Context, cities map[string]CityType, persist func(context.Context, map[string]CityType) error) error
+	Reload(ctx context.Context, load func(context.Context) (map[string]CityType, error)) error
+}
+
+// WeatherProvider geocodes city names and reports current weather.
+type WeatherProvider interface {
+	// Coordinates returns ErrValidation if the city is unknown.
+	Coordinates(ctx context.Context, city string) (CityType, error)
+	CurrentWeather(ctx context.Context, city CityType) (WeatherSample, error)
+	Ping(ctx context.Context) error
+}
+
+// Publisher hands email tasks to smtp_service.
+type Publisher interface {
+	Publish(ctx context.Context, task EmailTask) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Deps are the backends a Service is built from.
+type Deps struct {
+	Users     UserStore
+	Metrics   MetricsStore
+	Cities    CityRegistry
+	Provider  WeatherProvider
+	Publisher Publisher
+}
+
+// Options tunes the background work of a Service.
+type Options struct {
+	// IngestionInterval is how often current weather is collected.
+	IngestionInterval time.Duration
+	// OutboxInterval is how often queued emails are relayed when nothing
+	// wakes the relay earlier; OutboxBatch bounds one relay transaction.
+	OutboxInterval time.Duration
+	OutboxBatch    int
+}
+
+// Service is the weather API: the HTTP handlers, the background loops and
+// the state they share.
+type Service struct {
+	users     UserStore
+	metrics   MetricsStore
+	cities    CityRegistry
+	provider  WeatherProvider
+	publisher Publisher
+
+	ingestionInterval time.Duration
+	ingestion         *periodicTask
+	outboxInterval    time.Duration
+	outboxBatch       int
+	outbox            *periodicTask
+	// lastIngestionNano is the unix time of the last successful ingestion cycle.
+	lastIngestionNano atomic.Int64
+
+	ipLimiter    *rateLimiter
+	emailLimiter *rateLimiter
+
+	startedAt     time.Time
+	shuttingDown  atomic.Bool
+	providerProbe providerProbe
+}
+
+// NewService returns a service over deps. A nil Cities gets an empty registry.
+func NewService(deps Deps, opts Options) *Service {
+	if deps.Cities == nil {
+		deps.Cities = NewCityRegistry()
+	}
+	return &Service{
+		users:             deps.Users,
+		metrics:           deps.Metrics,
+		cities:            deps.Cities,
+		provider:          deps.Provider,
+		publisher:         deps.Publisher,
+		ingestionInterval: opts.IngestionInterval,
+		outboxInterval:    opts.OutboxInterval,
+		outboxBatch:       opts.OutboxBatch,
+		ipLimiter:         newRateLimiter(ipRate, ipBurst),
+		emailLimiter:      newRateLimiter(emailRate, emailBurst),
+		startedAt:         time.Now(),
+	}
+}
+
+// Start loads the city registry and starts the ingestion loop and the
+// outbox relay.
+func (s *Service) Start(ctx context.Context) error {
+	if err := s.ReloadCities(ctx); err != nil {
+		return err
+	}
+	s.ingestion = startPeriodicTask("ingestion", s.ingestionInterval, func() { s.runIngestion(s.ingestionInterval) })
+	s.outbox = startPeriodicTask("outbox relay", s.outboxInterval, func() { s.relayOutbox(s.outboxInterval) })
+	return nil
+}
+
+// ReloadCities refreshes the city registry from the metrics store.
+func (s *Service) ReloadCities(ctx context.Context) error {
+	return s.cities.Reload(ctx, s.metrics.LoadCities)
+}
+
+// publishEmail hands task to the publisher and counts the outcome.
+func (s *Service) publishEmail(ctx context.Context, task EmailTask) (err error) {
+	defer func() { emailPublished.WithLabelValues(task.Type, outcome(err)).Inc() }()
+	return s.publisher.Publish(ctx, task)
+}
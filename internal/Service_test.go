@@ -0,0 +1,290 @@
+package weatherservice
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type credentials struct {
+	Email    string   `json:"email"`
+	Password string   `json:"password"`
+	Cities   []string `json:"cities,omitempty"`
+}
+
+type userResp struct {
+	Email  string   `json:"email"`
+	Cities []string `json:"cities"`
+}
+
+const (
+	testEmail    = "alice@example.com"
+	testPassword = "correct horse 1"
+)
+
+func TestV1UserLifecycle(t *testing.T) {
+	h := newHarness(t)
+	login := credentials{Email: testEmail, Password: testPassword}
+
+	h.expect(http.StatusCreated, http.MethodPost, "/v1/createUser",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"Moscow"}}, nil)
+	h.expect(http.StatusConflict, http.MethodPost, "/v1/createUser",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"London"}}, nil)
+
+	var user userResp
+	h.expect(http.StatusOK, http.MethodPost, "/v1/getUserData", login, &user)
+	if user.Email != testEmail || !slices.Equal(user.Cities, []string{"Moscow"}) {
+		t.Fatalf("getUserData = %+v, want %s with [Moscow]", user, testEmail)
+	}
+
+	h.expect(http.StatusOK, http.MethodPost, "/v1/changeUserData",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"London", "Paris"}}, nil)
+	h.expect(http.StatusOK, http.MethodPost, "/v1/getUserData", login, &user)
+	if !slices.Equal(user.Cities, []string{"London", "Paris"}) {
+		t.Fatalf("cities after changeUserData = %v, want [London Paris]", user.Cities)
+	}
+	if got := h.svc.cities.Len(); got != 3 {
+		t.Errorf("registry has %d cities, want 3", got)
+	}
+
+	h.expect(http.StatusUnauthorized, http.MethodPost, "/v1/getUserData",
+		credentials{Email: testEmail, Password: "wrong password 1"}, nil)
+
+	h.expect(http.StatusOK, http.MethodDelete, "/v1/deleteUser", login, nil)
+	h.expect(http.StatusNotFound, http.MethodPost, "/v1/getUserData", login, nil)
+}
+
+func TestV1ChangeUserDataMethods(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusCreated, http.MethodPost, "/v1/createUser",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"Moscow"}}, nil)
+	login := credentials{Email: testEmail, Password: testPassword}
+
+	for _, c := range []struct {
+		method string
+		city   string
+	}{{http.MethodPut, "London"}, {http.MethodPatch, "Paris"}} {
+		h.expect(http.StatusOK, c.method, "/v1/changeUserData",
+			credentials{Email: testEmail, Password: testPassword, Cities: []string{c.city}}, nil)
+		var user userResp
+		h.expect(http.StatusOK, http.MethodPost, "/v1/getUserData", login, &user)
+		if !slices.Equal(user.Cities, []string{c.city}) {
+			t.Errorf("cities after %s changeUserData = %v, want [%s]", c.method, user.Cities, c.city)
+		}
+	}
+}
+
+func TestCreateUserWithUnknownCity(t *testing.T) {
+	h := newHarness(t)
+
+	h.expect(http.StatusBadRequest, http.MethodPost, "/v1/createUser",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"Moscow", "Atlantis"}}, nil)
+
+	h.expect(http.StatusNotFound, http.MethodPost, "/v1/getUserData",
+		credentials{Email: testEmail, Password: testPassword}, nil)
+	if got := h.svc.cities.Len(); got != 0 {
+		t.Errorf("registry has %d cities after a failed registration, want 0", got)
+	}
+}
+
+func TestGeocodingIsCached(t *testing.T) {
+	h := newHarness(t)
+
+	h.expect(http.StatusCreated, http.MethodPost, "/v1/createUser",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"Moscow"}}, nil)
+	h.expect(http.StatusCreated, http.MethodPost, "/v1/createUser",
+		credentials{Email: "bob@example.com", Password: testPassword, Cities: []string{"Moscow"}}, nil)
+
+	if geocode, _ := h.provider.calls(); geocode != 1 {
+		t.Errorf("geocoding calls = %d, want 1", geocode)
+	}
+}
+
+func TestIngestionTick(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusCreated, http.MethodPost, "/v1/createUser",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"Moscow", "London"}}, nil)
+
+	h.tick()
+
+	samples := h.metrics.Samples()
+	if len(samples) != 2 {
+		t.Fatalf("got %d samples, want 2", len(samples))
+	}
+	temps := map[string]float32{}
+	for _, s := range samples {
+		temps[s.City] = s.Temp
+	}
+	if temps["Moscow"] != 5.575 || temps["London"] != 5.151 {
+		t.Errorf("temperatures = %v, want Moscow 5.575 and London 5.151", temps)
+	}
+	if h.svc.lastIngestion().IsZero() {
+		t.Error("last ingestion not recorded")
+	}
+
+	// A provider failure fails the whole cycle without storing anything.
+	h.provider.setFailWeather(true)
+	h.tick()
+	if got := len(h.metrics.Samples()); got != 2 {
+		t.Errorf("got %d samples after a failed cycle, want 2", got)
+	}
+}
+
+func TestLockoutPublishesEmail(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusCreated, http.MethodPost, "/v2/users",
+		credentials{Email: testEmail, Password: testPassword}, nil)
+
+	for i := 0; i < lockoutThreshold; i++ {
+		if got := h.doAuth(http.MethodGet, "/v2/users/me", testEmail, "wrong password 1", nil, nil); got != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, got)
+		}
+	}
+
+	if got := len(h.users.PendingEmails()); got != 1 {
+		t.Fatalf("%d emails queued, want 1", got)
+	}
+	h.relay()
+	tasks := h.publisher.Published()
+	if len(tasks) != 1 || tasks[0].Type != "account_locked" || tasks[0].To != testEmail {
+		t.Fatalf("published %+v, want one account_locked email to %s", tasks, testEmail)
+	}
+	if tasks[0].Key == "" {
+		t.Error("published email has no idempotency key")
+	}
+	if got := len(h.users.PendingEmails()); got != 0 {
+		t.Errorf("%d emails still queued after relay, want 0", got)
+	}
+
+	if got := h.doAuth(http.MethodGet, "/v2/users/me", testEmail, testPassword, nil, nil); got != http.StatusTooManyRequests {
+		t.Errorf("login while locked: status %d, want 429", got)
+	}
+}
+
+func TestOutboxSurvivesBrokerOutage(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusCreated, http.MethodPost, "/v2/users",
+		credentials{Email: testEmail, Password: testPassword}, nil)
+
+	h.broker.setDown(true)
+	for i := 0; i < lockoutThreshold; i++ {
+		h.doAuth(http.MethodGet, "/v2/users/me", testEmail, "wrong password 1", nil, nil)
+	}
+	h.relay()
+	if got := len(h.users.PendingEmails()); got != 1 {
+		t.Fatalf("%d emails queued while the broker is down, want 1", got)
+	}
+
+	h.broker.setDown(false)
+	h.relay()
+	if got := len(h.publisher.Published()); got != 1 {
+		t.Errorf("published %d emails after the broker came back, want 1", got)
+	}
+	if got := len(h.users.PendingEmails()); got != 0 {
+		t.Errorf("%d emails still queued, want 0", got)
+	}
+}
+
+func TestV2Cities(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusCreated, http.MethodPost, "/v2/users",
+		credentials{Email: testEmail, Password: testPassword}, nil)
+
+	if got := h.doAuth(http.MethodPost, "/v2/users/me/cities/Paris", testEmail, testPassword, nil, nil); got != http.StatusCreated {
+		t.Fatalf("add city: status %d, want 201", got)
+	}
+	var user userResp
+	if got := h.doAuth(http.MethodGet, "/v2/users/me", testEmail, testPassword, nil, &user); got != http.StatusOK {
+		t.Fatalf("get me: status %d, want 200", got)
+	}
+	if !slices.Equal(user.Cities, []string{"Paris"}) {
+		t.Fatalf("cities = %v, want [Paris]", user.Cities)
+	}
+
+	if got := h.doAuth(http.MethodDelete, "/v2/users/me/cities/Paris", testEmail, testPassword, nil, nil); got != http.StatusNoContent {
+		t.Fatalf("remove city: status %d, want 204", got)
+	}
+	if got := h.doAuth(http.MethodDelete, "/v2/users/me/cities/Paris", testEmail, testPassword, nil, nil); got != http.StatusNotFound {
+		t.Errorf("remove city again: status %d, want 404", got)
+	}
+}
+
+func TestPatchMeChangesNothingOnError(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusCreated, http.MethodPost, "/v2/users",
+		credentials{Email: testEmail, Password: testPassword, Cities: []string{"Paris"}}, nil)
+
+	const newPassword = "battery staple 2"
+	for name, patch := range map[string]any{
+		"invalid city": map[string]any{"password": newPassword, "cities": []string{"Paris", "123"}},
+		"unknown city": map[string]any{"password": newPassword, "cities": []string{"Atlantis"}},
+	} {
+		if got := h.doAuth(http.MethodPatch, "/v2/users/me", testEmail, testPassword, patch, nil); got != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, got)
+		}
+		var user userResp
+		if got := h.doAuth(http.MethodGet, "/v2/users/me", testEmail, testPassword, nil, &user); got != http.StatusOK {
+			t.Fatalf("%s: old password rejected after a failed patch: status %d", name, got)
+		}
+		if !slices.Equal(user.Cities, []string{"Paris"}) {
+			t.Errorf("%s: cities = %v, want [Paris]", name, user.Cities)
+		}
+	}
+
+	patch := map[string]any{"password": newPassword, "cities": []string{"Moscow"}}
+	if got := h.doAuth(http.MethodPatch, "/v2/users/me", testEmail, testPassword, patch, nil); got != http.StatusOK {
+		t.Fatalf("valid patch: status %d, want 200", got)
+	}
+	var user userResp
+	if got := h.doAuth(http.MethodGet, "/v2/users/me", testEmail, newPassword, nil, &user); got != http.StatusOK {
+		t.Fatalf("new password: status %d, want 200", got)
+	}
+	if !slices.Equal(user.Cities, []string{"Moscow"}) {
+		t.Errorf("cities = %v, want [Moscow]", user.Cities)
+	}
+}
+
+func TestProbesAreNotRateLimited(t *testing.T) {
+	h := newHarness(t)
+
+	for i := 0; i < 3*ipBurst; i++ {
+		for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+			if got := h.do(http.MethodGet, path, nil, nil); got != http.StatusOK {
+				t.Fatalf("%s request %d: status %d, want 200", path, i+1, got)
+			}
+		}
+	}
+
+	limited := false
+	for i := 0; i < 3*ipBurst && !limited; i++ {
+		limited = h.do(http.MethodGet, "/v1/openapi.json", nil, nil) == http.StatusTooManyRequests
+	}
+	if !limited {
+		t.Error("API requests were not rate limited")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusOK, http.MethodGet, "/readyz", nil, nil)
+
+	h.svc.shuttingDown.Store(true)
+	h.expect(http.StatusServiceUnavailable, http.MethodGet, "/readyz", nil, nil)
+}
+
+func TestRequestMetricsBoundMethods(t *testing.T) {
+	h := newHarness(t)
+	before := testutil.CollectAndCount(httpRequests)
+
+	for _, method := range []string{"BREW", "PROPFIND", "X-ANYTHING"} {
+		h.expect(http.StatusMethodNotAllowed, method, "/v2/users", nil, nil)
+	}
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("unmatched", "other", "405")); got < 3 {
+		t.Errorf("unknown methods counted %v times as other, want 3", got)
+	}
+	if got := testutil.CollectAndCount(httpRequests) - before; got != 1 {
+		t.Errorf("unknown methods added %d series, want 1", got)
+	}
+}
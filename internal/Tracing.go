@@ -0,0 +1,168 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "weather_service"
+
+// tracer is usable before InitTracing: until a provider is installed its
+// spans are no-ops.
+var tracer = otel.Tracer("github.com/ilyaytrewq/WeatherServiceAPI/internal")
+
+var (
+	tracerProvider *sdktrace.TracerProvider
+	traceOutput    io.Closer
+)
+
+// InitTracing installs the span exporter selected by cfg.Exporter: "none"
+// disables tracing, "stdout" prints spans as JSON and "file" appends them to
+// cfg.File. W3C trace context is propagated either way so that traces started
+// by callers are continued.
+func InitTracing(cfg config.Tracing) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var out io.Writer
+	switch cfg.Exporter {
+	case "", "none":
+		return nil
+	case "stdout":
+		out = os.Stdout
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("InitTracing: open %s: %w", cfg.File, err)
+		}
+		out, traceOutput = f, f
+	default:
+		return fmt.Errorf("InitTracing: unknown exporter %q", cfg.Exporter)
+	}
+
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(out))
+	if err != nil {
+		return fmt.Errorf("InitTracing: exporter: %w", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	return nil
+}
+
+// CloseTracing flushes buffered spans and closes the trace file.
+func CloseTracing(ctx context.Context) error {
+	var errs []error
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("CloseTracing: %w", err))
+		}
+	}
+	if traceOutput != nil {
+		if err := traceOutput.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("CloseTracing: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// endSpan records err on span, if any, and ends it. A missing row is an
+// answer rather than a failure.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startPostgresSpan starts a client span for one statement; name is the
+// operation and the table, e.g. "SELECT users".
+func startPostgresSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	op, table, _ := strings.Cut(name, " ")
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemPostgreSQL,
+		semconv.DBOperationName(op),
+		semconv.DBCollectionName(table),
+	))
+}
+
+func startClickhouseSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	op, table, _ := strings.Cut(name, " ")
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBOperationName(op),
+		semconv.DBCollectionName(table),
+	))
+}
+
+// TraceRequests starts a server span per request, continuing the caller's
+// trace if the request carries a traceparent header. It must run inside
+// InstrumentRequests, which provides the matched route.
+func TraceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			attribute.String("request.id", requestID(r)),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routePattern(r)
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// amqpHeaders carries trace context in AMQP message headers.
+type amqpHeaders amqp.Table
+
+func (h amqpHeaders) Get(key string) string {
+	v, _ := h[key].(string)
+	return v
+}
+
+func (h amqpHeaders) Set(key, value string) {
+	h[key] = value
+}
+
+func (h amqpHeaders) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -1,15 +1,13 @@
 package weatherservice
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log" 
+	"log/slog"
 	"net/http"
-	"os"
 
-	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -19,204 +17,237 @@ type UserData struct {
 	Cities   []string `json:"cities"`
 }
 
-var DB *sql.DB
+func (s *Service) createUser(r *http.Request) error {
+	var userData UserData
+	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
+		slog.InfoContext(r.Context(), "createUser: decode error", "err", err)
+		return newError(ErrValidation, "invalid JSON body", fmt.Errorf("createUser: decode error: %w", err))
+	}
 
-func InitPostgres() error {
-	host := os.Getenv("POSTGRES_HOST")
-	port := os.Getenv("POSTGRES_PORT")
-	user := os.Getenv("POSTGRES_USER")
-	password := os.Getenv("POSTGRES_PASSWORD")
-	dbname := os.Getenv("POSTGRES_DB")
+	slog.DebugContext(r.Context(), "createUser: received user data", "email", userData.Email, "cities", userData.Cities)
 
-	if host == "" || port == "" || user == "" || dbname == "" {
-		return fmt.Errorf("postgres environment variables are not set properly")
+	if err := validateNewUser(&userData); err != nil {
+		return fmt.Errorf("createUser: %w", err)
 	}
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+	if err := s.registerUser(r.Context(), userData); err != nil {
+		return fmt.Errorf("createUser: %w", err)
+	}
+	return nil
+}
 
-	var err error
-	DB, err = sql.Open("postgres", psqlInfo)
-	if err != nil {
-		return fmt.Errorf("failed to open Postgres: %w", err)
+func (s *Service) changeUserData(r *http.Request) error {
+	var req UserData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.InfoContext(r.Context(), "changeUserData: decode error", "err", err)
+		return newError(ErrValidation, "invalid JSON body", fmt.Errorf("changeUserData: decode error: %w", err))
 	}
+	slog.DebugContext(r.Context(), "changeUserData: received request", "email", req.Email, "cities", req.Cities)
 
-	if err = DB.Ping(); err != nil {
-		return fmt.Errorf("failed to ping Postgres: %w", err)
+	if err := validateCitiesUpdate(&req); err != nil {
+		return fmt.Errorf("changeUserData: %w", err)
 	}
 
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			email VARCHAR(255) NOT NULL PRIMARY KEY,
-			password VARCHAR(255) NOT NULL,
-			cities TEXT[] DEFAULT '{}'
-		);
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create users table: %w", err)
+	if _, err := s.authenticateUser(r.Context(), req.Email, req.Password); err != nil {
+		return fmt.Errorf("changeUserData: %w", err)
 	}
 
+	if err := s.setUserCities(r.Context(), req.Email, req.Cities); err != nil {
+		return fmt.Errorf("changeUserData: %w", err)
+	}
 	return nil
 }
 
-func createUser(r *http.Request) error {
-	var userData UserData
-	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
-		log.Printf("createUser: decode error: %v", err) 
-		return fmt.Errorf("createUser: decode error: %w", err)
+func (s *Service) getUserData(r *http.Request) (UserData, error) {
+	var req UserData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.InfoContext(r.Context(), "getUserData: decode error", "err", err)
+		return UserData{}, newError(ErrValidation, "invalid JSON body", fmt.Errorf("getUserData: decode error: %w", err))
 	}
+	slog.DebugContext(r.Context(), "getUserData: received request", "email", req.Email)
 
-	safeToLog := struct {
-		Email  string
-		Cities []string
-	}{
-		Email:  userData.Email,
-		Cities: userData.Cities,
+	if err := validateLogin(&req); err != nil {
+		return UserData{}, fmt.Errorf("getUserData: %w", err)
 	}
-	log.Printf("createUser: received user data: %+v", safeToLog)
 
-	if userData.Email == "" || userData.Password == "" {
-		return errors.New("createUser: email and password are required")
+	user, err := s.authenticateUser(r.Context(), req.Email, req.Password)
+	if err != nil {
+		return UserData{}, fmt.Errorf("getUserData: %w", err)
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(userData.Password), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("createUser: password hashing error: %v", err) 
-		return fmt.Errorf("createUser: password hashing error: %w", err)
+	slog.DebugContext(r.Context(), "getUserData: success", "email", user.Email, "cities", user.Cities)
+	return user, nil
+}
+
+func (s *Service) deleteUser(r *http.Request) error {
+	var req UserData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.InfoContext(r.Context(), "deleteUser: decode error", "err", err)
+		return newError(ErrValidation, "invalid JSON body", fmt.Errorf("deleteUser: decode error: %w", err))
 	}
+	slog.DebugContext(r.Context(), "deleteUser: received request", "email", req.Email)
 
-	if err := addCitiesToDB(userData.Cities); err != nil {
-		log.Printf("createUser: addCitiesToDB error: %v", err) 
-		return fmt.Errorf("createUser: addCitiesToDB error: %w", err)
+	if err := validateLogin(&req); err != nil {
+		return fmt.Errorf("deleteUser: %w", err)
 	}
 
-	_, err = DB.Exec(`
-		INSERT INTO users (email, password, cities)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (email) DO NOTHING;
-	`, userData.Email, string(hash), pq.Array(userData.Cities))
-	if err != nil {
-		log.Printf("createUser: insert error: %v", err)
-		return fmt.Errorf("createUser: insert error: %w", err)
+	if _, err := s.authenticateUser(r.Context(), req.Email, req.Password); err != nil {
+		return fmt.Errorf("deleteUser: %w", err)
 	}
 
-	log.Printf("createUser: user %s created (or already exists)", userData.Email) // CHANGED
+	if err := s.removeUser(r.Context(), req.Email); err != nil {
+		return fmt.Errorf("deleteUser: %w", err)
+	}
 	return nil
 }
 
-func changeUserData(r *http.Request) error {
-	var req UserData
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("changeUserData: decode error: %v", err)
-		return fmt.Errorf("changeUserData: decode error: %w", err)
+// authenticateUser checks the password of the user with the given, already
+// normalized, email and returns the stored user data without the password.
+func (s *Service) authenticateUser(ctx context.Context, email, password string) (UserData, error) {
+	if err := s.checkLoginAllowed(ctx, email); err != nil {
+		slog.InfoContext(ctx, "authenticateUser: login refused", "email", email, "err", err)
+		return UserData{}, err
 	}
-	log.Printf("changeUserData: received request for %s, cities=%v", req.Email, req.Cities) 
 
-	if req.Email == "" || req.Password == "" {
-		return errors.New("changeUserData: email and password are required")
+	user, err := s.users.GetUser(ctx, email)
+	if err != nil {
+		slog.InfoContext(ctx, "authenticateUser: lookup failed", "email", email, "err", err)
+		return UserData{}, fmt.Errorf("authenticateUser: %w", err)
 	}
 
-	var storedHash string
-	err := DB.QueryRow("SELECT password FROM users WHERE email=$1", req.Email).Scan(&storedHash)
-	if err == sql.ErrNoRows {
-		log.Printf("changeUserData: user %s not found", req.Email)
-		return errors.New("changeUserData: user not found")
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		slog.InfoContext(ctx, "authenticateUser: incorrect password", "email", email)
+		s.recordLoginFailure(ctx, email)
+		return UserData{}, newError(ErrWrongPassword, "incorrect password", nil)
 	}
-	if err != nil {
-		log.Printf("changeUserData: select error: %v", err) 
-		return fmt.Errorf("changeUserData: select error: %w", err)
+	s.clearLoginFailures(ctx, email)
+
+	return UserData{
+		Email:  email,
+		Cities: user.Cities,
+	}, nil
+}
+
+// registerUser creates the user and registers their cities. The user is
+// stored only once the cities are, so no user is left without its cities.
+// The reverse does not hold: if the user cannot be committed after that, the
+// new cities stay registered.
+func (s *Service) registerUser(ctx context.Context, user UserData) error {
+	// Reject a taken email before spending provider quota on its cities;
+	// CreateUser checks again.
+	_, err := s.users.GetUser(ctx, user.Email)
+	if err == nil {
+		slog.InfoContext(ctx, "registerUser: user already exists", "email", user.Email)
+		return newError(ErrConflict, "user already exists", nil)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("registerUser: %w", err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password)); err != nil {
-		log.Printf("changeUserData: incorrect password for %s", req.Email) 
-		return errors.New("changeUserData: incorrect password")
+	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		slog.ErrorContext(ctx, "registerUser: password hashing error", "err", err)
+		return fmt.Errorf("password hashing error: %w", err)
 	}
 
-	if err := addCitiesToDB(req.Cities); err != nil {
-		log.Printf("changeUserData: addCitiesToDB error: %v", err) 
-		return fmt.Errorf("changeUserData: addCitiesToDB error: %w", err)
+	cities, err := s.resolveCities(ctx, user.Cities)
+	if err != nil {
+		slog.WarnContext(ctx, "registerUser: resolveCities error", "err", err)
+		return fmt.Errorf("resolveCities error: %w", err)
 	}
 
-	_, err = DB.Exec("UPDATE users SET cities = $1 WHERE email = $2", pq.Array(req.Cities), req.Email)
+	stored := StoredUser{Email: user.Email, PasswordHash: string(hash), Cities: user.Cities}
+	err = s.users.CreateUser(ctx, stored, func(ctx context.Context) error {
+		return s.storeCities(ctx, cities)
+	})
 	if err != nil {
-		log.Printf("changeUserData: update error: %v", err) 
-		return fmt.Errorf("changeUserData: update error: %w", err)
+		slog.InfoContext(ctx, "registerUser: not created", "email", user.Email, "err", err)
+		return fmt.Errorf("registerUser: %w", err)
 	}
 
-	log.Printf("changeUserData: user %s cities updated", req.Email) 
+	slog.InfoContext(ctx, "registerUser: user created", "email", user.Email)
 	return nil
 }
 
-func getUserData(r *http.Request) (UserData, error) {
-	var req UserData
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("getUserData: decode error: %v", err) 
-		return UserData{}, fmt.Errorf("getUserData: decode error: %w", err)
+func (s *Service) setUserCities(ctx context.Context, email string, cities []string) error {
+	if err := s.addCities(ctx, cities); err != nil {
+		slog.WarnContext(ctx, "setUserCities: addCities error", "err", err)
+		return fmt.Errorf("addCities error: %w", err)
 	}
-	log.Printf("getUserData: request for %s", req.Email) 
 
-	if req.Email == "" || req.Password == "" {
-		return UserData{}, errors.New("getUserData: email and password are required")
+	if err := s.users.SetCities(ctx, email, cities); err != nil {
+		return fmt.Errorf("setUserCities: %w", err)
 	}
 
-	var storedHash string
-	var cities []string
-	err := DB.QueryRow("SELECT password, cities FROM users WHERE email=$1", req.Email).Scan(&storedHash, pq.Array(&cities))
-	if err == sql.ErrNoRows {
-		log.Printf("getUserData: user %s not found", req.Email) 
-		return UserData{}, errors.New("getUserData: user not found")
-	}
-	if err != nil {
-		log.Printf("getUserData: select error: %v", err) 
-		return UserData{}, fmt.Errorf("getUserData: select error: %w", err)
+	slog.InfoContext(ctx, "setUserCities: cities updated", "email", email)
+	return nil
+}
+
+// addUserCity appends city to the user's list unless it is already there.
+func (s *Service) addUserCity(ctx context.Context, email, city string) error {
+	if err := s.addCities(ctx, []string{city}); err != nil {
+		slog.WarnContext(ctx, "addUserCity: addCities error", "err", err)
+		return fmt.Errorf("addCities error: %w", err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password)); err != nil {
-		log.Printf("getUserData: incorrect password for %s", req.Email) 
-		return UserData{}, errors.New("getUserData: incorrect password")
+	if err := s.users.AddCity(ctx, email, city); err != nil {
+		return fmt.Errorf("addUserCity: %w", err)
 	}
 
-	log.Printf("getUserData: success for %s, cities=%v", req.Email, cities) 
-	return UserData{
-		Email:  req.Email,
-		Cities: cities,
-	}, nil
+	slog.InfoContext(ctx, "addUserCity: subscribed", "email", email, "city", city)
+	return nil
 }
 
-func deleteUser(r *http.Request) error {
-	var req UserData
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("deleteUser: decode error: %v", err) 
-		return fmt.Errorf("deleteUser: decode error: %w", err)
+// removeUserCity drops city from the user's list and reports whether it was there.
+func (s *Service) removeUserCity(ctx context.Context, email, city string) (bool, error) {
+	removed, err := s.users.RemoveCity(ctx, email, city)
+	if err != nil {
+		return false, fmt.Errorf("removeUserCity: %w", err)
 	}
-	log.Printf("deleteUser: request for %s", req.Email) 
 
-	if req.Email == "" || req.Password == "" {
-		return errors.New("deleteUser: email and password are required")
+	slog.InfoContext(ctx, "removeUserCity: unsubscribed", "email", email, "city", city, "removed", removed)
+	return removed, nil
+}
+
+// updateUser changes the password and the cities that are not nil. The new
+// cities are registered first and both fields are then written in one store
+// call, so a failure leaves the user as it was.
+func (s *Service) updateUser(ctx context.Context, email string, password *string, cities []string) error {
+	if password == nil && cities == nil {
+		return nil
 	}
 
-	var storedHash string
-	err := DB.QueryRow("SELECT password FROM users WHERE email=$1", req.Email).Scan(&storedHash)
-	if err == sql.ErrNoRows {
-		log.Printf("deleteUser: user %s not found", req.Email) 
-		return errors.New("deleteUser: user not found")
+	var hash *string
+	if password != nil {
+		b, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+		if err != nil {
+			slog.ErrorContext(ctx, "updateUser: password hashing error", "err", err)
+			return fmt.Errorf("password hashing error: %w", err)
+		}
+		h := string(b)
+		hash = &h
 	}
-	if err != nil {
-		log.Printf("deleteUser: select error: %v", err) 
-		return fmt.Errorf("deleteUser: select error: %w", err)
+
+	if cities != nil {
+		if err := s.addCities(ctx, cities); err != nil {
+			slog.WarnContext(ctx, "updateUser: addCities error", "err", err)
+			return fmt.Errorf("addCities error: %w", err)
+		}
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password)); err != nil {
-		log.Printf("deleteUser: incorrect password for %s", req.Email) 
-		return errors.New("deleteUser: incorrect password")
+	if err := s.users.UpdateUser(ctx, email, hash, cities); err != nil {
+		return fmt.Errorf("updateUser: %w", err)
 	}
 
-	_, err = DB.Exec("DELETE FROM users WHERE email=$1", req.Email)
-	if err != nil {
-		log.Printf("deleteUser: delete error: %v", err) 
-		return fmt.Errorf("deleteUser: delete error: %w", err)
+	slog.InfoContext(ctx, "updateUser: user updated", "email", email, "password_changed", password != nil, "cities_changed", cities != nil)
+	return nil
+}
+
+func (s *Service) removeUser(ctx context.Context, email string) error {
+	if err := s.users.DeleteUser(ctx, email); err != nil {
+		return fmt.Errorf("removeUser: %w", err)
 	}
 
-	log.Printf("deleteUser: user %s deleted", req.Email) 
+	slog.InfoContext(ctx, "removeUser: user deleted", "email", email)
 	return nil
 }
@@ -0,0 +1,175 @@
+package weatherservice
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/internal/api"
+)
+
+const (
+	maxEmailLen = 254
+
+	minPasswordLen = 8
+	// bcrypt silently ignores everything past 72 bytes.
+	maxPasswordLen = 72
+
+	maxCitiesPerUser = 20
+	maxCityNameLen   = 100
+)
+
+// FieldError describes one invalid field of a request payload.
+type FieldError = api.FieldError
+
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	e := newError(ErrValidation, "invalid request", nil)
+	e.Details = v.errs
+	return e
+}
+
+// normalizeEmail returns the bare, lower-cased address. Display names and
+// angle brackets are rejected so that one mailbox maps to exactly one user.
+func normalizeEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	if email == "" || len(email) > maxEmailLen {
+		return "", false
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+func checkPassword(v *validator, password string) {
+	switch {
+	case len(password) < minPasswordLen:
+		v.add("password", "must be at least %d characters", minPasswordLen)
+	case len(password) > maxPasswordLen:
+		v.add("password", "must be at most %d bytes", maxPasswordLen)
+	case !strings.ContainsFunc(password, unicode.IsLetter) || !strings.ContainsFunc(password, unicode.IsDigit):
+		v.add("password", "must contain a letter and a digit")
+	}
+}
+
+// normalizeCity trims the name and collapses inner whitespace. Only letters,
+// combining marks, spaces and the punctuation found in real place names
+// (including the comma of "London,GB") are accepted.
+func normalizeCity(city string) (string, bool) {
+	city = strings.Join(strings.Fields(city), " ")
+	if city == "" || utf8.RuneCountInString(city) > maxCityNameLen || !utf8.ValidString(city) {
+		return "", false
+	}
+	for _, c := range city {
+		if unicode.IsLetter(c) || unicode.IsMark(c) || c == ' ' {
+			continue
+		}
+		if strings.ContainsRune("-'’.,()", c) {
+			continue
+		}
+		return "", false
+	}
+	return city, true
+}
+
+func checkCities(v *validator, cities []string) []string {
+	if len(cities) > maxCitiesPerUser {
+		v.add("cities", "at most %d cities are allowed", maxCitiesPerUser)
+		return nil
+	}
+
+	normalized := make([]string, 0, len(cities))
+	seen := make(map[string]bool, len(cities))
+	for i, city := range cities {
+		name, ok := normalizeCity(city)
+		if !ok {
+			v.add(fmt.Sprintf("cities[%d]", i), "invalid city name")
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		normalized = append(normalized, name)
+	}
+	return normalized
+}
+
+func checkEmail(v *validator, email string) string {
+	normalized, ok := normalizeEmail(email)
+	if !ok {
+		v.add("email", "must be a valid email address")
+	}
+	return normalized
+}
+
+func checkLogin(v *validator, user *UserData) {
+	user.Email = checkEmail(v, user.Email)
+	if user.Password == "" {
+		v.add("password", "is required")
+	}
+}
+
+// validateLogin normalizes the credentials used to look a user up. The
+// password policy is not applied so that existing accounts can still log in.
+func validateLogin(user *UserData) error {
+	var v validator
+	checkLogin(&v, user)
+	return v.err()
+}
+
+// validateNewUser normalizes a registration payload in place.
+func validateNewUser(user *UserData) error {
+	var v validator
+	user.Email = checkEmail(&v, user.Email)
+	checkPassword(&v, user.Password)
+	user.Cities = checkCities(&v, user.Cities)
+	return v.err()
+}
+
+// validateCitiesUpdate normalizes the credentials and the new city list of
+// a v1 update.
+func validateCitiesUpdate(user *UserData) error {
+	var v validator
+	checkLogin(&v, user)
+	user.Cities = checkCities(&v, user.Cities)
+	return v.err()
+}
+
+// validateUserPatch checks the fields of a user update that are set and
+// returns the normalized cities, nil if they are not being changed.
+func validateUserPatch(password *string, cities *[]string) ([]string, error) {
+	var v validator
+	if password != nil {
+		checkPassword(&v, *password)
+	}
+	var normalized []string
+	if cities != nil {
+		normalized = checkCities(&v, *cities)
+	}
+	return normalized, v.err()
+}
+
+func validateCity(city string) (string, error) {
+	name, ok := normalizeCity(city)
+	if !ok {
+		var v validator
+		v.add("city", "invalid city name")
+		return "", v.err()
+	}
+	return name, nil
+}
@@ -0,0 +1,14 @@
+// Package api holds the OpenAPI contract of the service, the request and
+// response types generated from it and a validator for incoming requests.
+package api
+
+import (
+	_ "embed"
+)
+
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.4.1 -generate types -package api -o Types.gen.go openapi.json
+
+// Spec is the OpenAPI 3 document served at /v1/openapi.json.
+//
+//go:embed openapi.json
+var Spec []byte
@@ -0,0 +1,147 @@
+// Package api provides primitives to interact with the openapi HTTP API.
+//
+// Code generated by github.com/oapi-codegen/oapi-codegen/v2 version v2.4.1 DO NOT EDIT.
+package api
+
+const (
+	BasicAuthScopes = "basicAuth.Scopes"
+)
+
+// Defines values for CheckStatus.
+const (
+	CheckStatusFail CheckStatus = "fail"
+	CheckStatusOk   CheckStatus = "ok"
+)
+
+// Defines values for ErrorDetailCode.
+const (
+	Conflict            ErrorDetailCode = "conflict"
+	Internal            ErrorDetailCode = "internal"
+	MethodNotAllowed    ErrorDetailCode = "method_not_allowed"
+	NotFound            ErrorDetailCode = "not_found"
+	PayloadTooLarge     ErrorDetailCode = "payload_too_large"
+	TooManyRequests     ErrorDetailCode = "too_many_requests"
+	Unauthorized        ErrorDetailCode = "unauthorized"
+	UpstreamUnavailable ErrorDetailCode = "upstream_unavailable"
+	ValidationFailed    ErrorDetailCode = "validation_failed"
+	WrongPassword       ErrorDetailCode = "wrong_password"
+)
+
+// Defines values for HealthStatus.
+const (
+	HealthStatusDegraded HealthStatus = "degraded"
+	HealthStatusFail     HealthStatus = "fail"
+	HealthStatusOk       HealthStatus = "ok"
+)
+
+// Check defines model for Check.
+type Check struct {
+	// AgeSeconds time since the last successful run, for periodic work
+	AgeSeconds *int `json:"age_seconds,omitempty"`
+
+	// Critical a failing critical check makes the service not ready
+	Critical  bool        `json:"critical"`
+	Error     *string     `json:"error,omitempty"`
+	LatencyMs *int        `json:"latency_ms,omitempty"`
+	Status    CheckStatus `json:"status"`
+}
+
+// CheckStatus defines model for Check.Status.
+type CheckStatus string
+
+// City defines model for City.
+type City struct {
+	City CityName `json:"city"`
+}
+
+// CityList defines model for CityList.
+type CityList = []CityName
+
+// CityName defines model for CityName.
+type CityName = string
+
+// Credentials defines model for Credentials.
+type Credentials struct {
+	Cities   *CityList `json:"cities,omitempty"`
+	Email    Email     `json:"email"`
+	Password string    `json:"password"`
+}
+
+// Email defines model for Email.
+type Email = string
+
+// Error defines model for Error.
+type Error struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail defines model for ErrorDetail.
+type ErrorDetail struct {
+	Code      ErrorDetailCode `json:"code"`
+	Details   *[]FieldError   `json:"details,omitempty"`
+	Message   string          `json:"message"`
+	RequestId *string         `json:"request_id,omitempty"`
+}
+
+// ErrorDetailCode defines model for ErrorDetail.Code.
+type ErrorDetailCode string
+
+// FieldError defines model for FieldError.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Health defines model for Health.
+type Health struct {
+	Checks map[string]Check `json:"checks"`
+	Status HealthStatus     `json:"status"`
+}
+
+// HealthStatus defines model for Health.Status.
+type HealthStatus string
+
+// Message defines model for Message.
+type Message struct {
+	Message string `json:"message"`
+}
+
+// NewUser defines model for NewUser.
+type NewUser struct {
+	Cities   *CityList `json:"cities,omitempty"`
+	Email    Email     `json:"email"`
+	Password string    `json:"password"`
+}
+
+// User defines model for User.
+type User struct {
+	Cities CityList `json:"cities"`
+	Email  Email    `json:"email"`
+}
+
+// UserPatch defines model for UserPatch.
+type UserPatch struct {
+	Cities   *CityList `json:"cities,omitempty"`
+	Password *string   `json:"password,omitempty"`
+}
+
+// RateLimited defines model for RateLimited.
+type RateLimited = Error
+
+// ChangeUserDataV1JSONRequestBody defines body for ChangeUserDataV1 for application/json ContentType.
+type ChangeUserDataV1JSONRequestBody = Credentials
+
+// CreateUserV1JSONRequestBody defines body for CreateUserV1 for application/json ContentType.
+type CreateUserV1JSONRequestBody = NewUser
+
+// DeleteUserV1JSONRequestBody defines body for DeleteUserV1 for application/json ContentType.
+type DeleteUserV1JSONRequestBody = Credentials
+
+// GetUserDataV1JSONRequestBody defines body for GetUserDataV1 for application/json ContentType.
+type GetUserDataV1JSONRequestBody = Credentials
+
+// CreateUserJSONRequestBody defines body for CreateUser for application/json ContentType.
+type CreateUserJSONRequestBody = NewUser
+
+// PatchMeJSONRequestBody defines body for PatchMe for application/json ContentType.
+type PatchMeJSONRequestBody = UserPatch
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxBodyBytes bounds how much of a request body is read for validation.
+const maxBodyBytes = 1 << 20
+
+var (
+	// ErrNoRoute means the path is not described by the document.
+	ErrNoRoute = errors.New("no such route")
+)
+
+// MethodError is returned for a known path called with an undocumented method.
+type MethodError struct {
+	Allowed []string
+}
+
+func (e *MethodError) Error() string {
+	return "method not allowed, use " + strings.Join(e.Allowed, ", ")
+}
+
+// ValidationError lists every violation of the request schema.
+type ValidationError struct {
+	Details []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Details))
+	for _, d := range e.Details {
+		msgs = append(msgs, d.Field+": "+d.Message)
+	}
+	return "request does not match schema: " + strings.Join(msgs, "; ")
+}
+
+// schema is the subset of JSON Schema the document uses.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *additional        `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MaxItems             *int               `json:"maxItems"`
+	Enum                 []string           `json:"enum"`
+}
+
+// additional is the value of additionalProperties: either a boolean or the
+// schema every extra property must match.
+type additional struct {
+	forbidden bool
+	schema    *schema
+}
+
+func (a *additional) UnmarshalJSON(data []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(data, &allowed); err == nil {
+		a.forbidden = !allowed
+		return nil
+	}
+	return json.Unmarshal(data, &a.schema)
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool `json:"required"`
+	Content  map[string]struct {
+		Schema *schema `json:"schema"`
+	} `json:"content"`
+}
+
+type operation struct {
+	Parameters  []parameter  `json:"parameters"`
+	RequestBody *requestBody `json:"requestBody"`
+}
+
+type route struct {
+	segments   []string
+	parameters []parameter
+	operations map[string]operation
+}
+
+// Validator checks requests against the paths of an OpenAPI document.
+type Validator struct {
+	routes  []route
+	schemas map[string]*schema
+}
+
+// NewValidator parses doc. Only the keywords listed in schema are enforced.
+func NewValidator(doc []byte) (*Validator, error) {
+	var raw struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]*schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(doc, &raw); err != nil {
+		return nil, fmt.Errorf("NewValidator: decode: %w", err)
+	}
+
+	v := &Validator{schemas: raw.Components.Schemas}
+	for path, item := range raw.Paths {
+		rt := route{
+			segments:   strings.Split(strings.Trim(path, "/"), "/"),
+			operations: make(map[string]operation),
+		}
+		for key, body := range item {
+			if key == "parameters" {
+				if err := json.Unmarshal(body, &rt.parameters); err != nil {
+					return nil, fmt.Errorf("NewValidator: %s parameters: %w", path, err)
+				}
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(body, &op); err != nil {
+				return nil, fmt.Errorf("NewValidator: %s %s: %w", key, path, err)
+			}
+			rt.operations[strings.ToUpper(key)] = op
+		}
+		v.routes = append(v.routes, rt)
+	}
+	return v, nil
+}
+
+// ValidateRequest checks the path parameters and the JSON body of r. The
+// body is read and replaced, so handlers can decode it again.
+func (v *Validator) ValidateRequest(r *http.Request) error {
+	rt, params, ok := v.match(r.URL.EscapedPath())
+	if !ok {
+		return ErrNoRoute
+	}
+	op, ok := rt.operations[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(rt.operations))
+		for method := range rt.operations {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		return &MethodError{Allowed: allowed}
+	}
+
+	c := checker{schemas: v.schemas}
+	for _, list := range [][]parameter{rt.parameters, op.Parameters} {
+		for _, p := range list {
+			if p.In == "path" {
+				c.check(p.Schema, params[p.Name], p.Name)
+			}
+		}
+	}
+
+	if op.RequestBody != nil {
+		if err := v.checkBody(r, op.RequestBody, &c); err != nil {
+			return err
+		}
+	}
+
+	if len(c.errs) > 0 {
+		return &ValidationError{Details: c.errs}
+	}
+	return nil
+}
+
+func (v *Validator) checkBody(r *http.Request, rb *requestBody, c *checker) error {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil {
+		return fmt.Errorf("ValidateRequest: read body: %w", err)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	if len(data) > maxBodyBytes {
+		c.add("body", "must be at most %d bytes", maxBodyBytes)
+		return nil
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		if rb.Required {
+			c.add("body", "is required")
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var body interface{}
+	if err := dec.Decode(&body); err != nil {
+		c.add("body", "must be valid JSON")
+		return nil
+	}
+	c.check(rb.Content["application/json"].Schema, body, "")
+	return nil
+}
+
+func (v *Validator) match(path string) (route, map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, rt := range v.routes {
+		if len(rt.segments) != len(segments) {
+			continue
+		}
+		params := make(map[string]string)
+		matched := true
+		for i, seg := range rt.segments {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				value, err := url.PathUnescape(segments[i])
+				if err != nil || value == "" {
+					matched = false
+					break
+				}
+				params[seg[1:len(seg)-1]] = value
+				continue
+			}
+			if seg != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rt, params, true
+		}
+	}
+	return route{}, nil, false
+}
+
+func resolveRef(schemas map[string]*schema, s *schema) *schema {
+	for s != nil && s.Ref != "" {
+		s = schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+type checker struct {
+	schemas map[string]*schema
+	errs    []FieldError
+}
+
+func (c *checker) add(field, format string, args ...interface{}) {
+	c.errs = append(c.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) check(s *schema, value interface{}, field string) {
+	s = resolveRef(c.schemas, s)
+	if s == nil {
+		return
+	}
+	name := field
+	if name == "" {
+		name = "body"
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			c.add(name, "must be an object")
+			return
+		}
+		for _, req := range s.Required {
+			if _, ok := obj[req]; !ok {
+				c.add(join(field, req), "is required")
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			prop, ok := s.Properties[key]
+			if !ok && s.AdditionalProperties != nil {
+				if s.AdditionalProperties.forbidden {
+					c.add(join(field, key), "is not allowed")
+					continue
+				}
+				prop = s.AdditionalProperties.schema
+			}
+			c.check(prop, obj[key], join(field, key))
+		}
+
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			c.add(name, "must be an array")
+			return
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			c.add(name, "must have at most %d items", *s.MaxItems)
+		}
+		for i, item := range arr {
+			c.check(s.Items, item, fmt.Sprintf("%s[%d]", name, i))
+		}
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			c.add(name, "must be a string")
+			return
+		}
+		n := utf8.RuneCountInString(str)
+		if s.MinLength != nil && n < *s.MinLength {
+			c.add(name, "must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			c.add(name, "must be at most %d characters", *s.MaxLength)
+		}
+		if len(s.Enum) > 0 && !contains(s.Enum, str) {
+			c.add(name, "must be one of %s", strings.Join(s.Enum, ", "))
+		}
+	}
+}
+
+func join(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
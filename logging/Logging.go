@@ -0,0 +1,131 @@
+// Package logging configures structured, leveled logging for the API and the
+// email worker. Every record passes through the redaction rules in Redact.go
+// and picks up the request-scoped fields stored in its context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// level is shared by every handler created by Setup, so changing it takes
+	// effect immediately.
+	level     = new(slog.LevelVar)
+	baseLevel slog.Level
+)
+
+// Setup installs the default logger. format is "text" or "json"; lvl is one
+// of debug, info, warn or error. Output of the standard log package is
+// routed through the same handler.
+func Setup(w io.Writer, format, lvl string) error {
+	l, err := ParseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	baseLevel = l
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var h slog.Handler
+	switch format {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("logging: unknown format %q", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return 0, fmt.Errorf("logging: unknown level %q", s)
+	}
+	return l, nil
+}
+
+// Level reports the current level.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// SetLevel changes the level of every logger at runtime.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+	slog.Info("logging: level changed", "level", l.String())
+}
+
+// WatchSignals switches to debug on SIGUSR1 and back to the configured level
+// on SIGUSR2 until ctx is cancelled.
+func WatchSignals(ctx context.Context) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigc)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigc:
+			if sig == syscall.SIGUSR1 {
+				SetLevel(slog.LevelDebug)
+			} else {
+				SetLevel(baseLevel)
+			}
+		}
+	}
+}
+
+type attrsKey struct{}
+
+// WithAttrs returns a context whose log records carry attrs in addition to
+// any attached earlier.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(prev)+len(attrs))
+	merged = append(merged, prev...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, attrsKey{}, merged)
+}
+
+// contextHandler adds the fields attached with WithAttrs and the current
+// trace and span IDs to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
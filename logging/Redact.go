@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// secretKeys are attribute keys whose values are never logged.
+var secretKeys = map[string]bool{
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"authorization": true,
+	"api_key":       true,
+	"appid":         true,
+}
+
+// emailKeys are attribute keys that hold an email address.
+var emailKeys = map[string]bool{
+	"email": true,
+	"to":    true,
+	"from":  true,
+}
+
+var (
+	secretParam = regexp.MustCompile(`(?i)\b(appid|api_key|apikey|token|password)=[^&\s"']+`)
+	emailAddr   = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+)
+
+// Redact masks secrets passed as key=value pairs, as in URLs and DSNs, and
+// email addresses found anywhere in s.
+func Redact(s string) string {
+	s = secretParam.ReplaceAllString(s, "$1="+redacted)
+	return emailAddr.ReplaceAllStringFunc(s, RedactEmail)
+}
+
+// RedactEmail keeps the first character of the local part and the domain:
+// "alice@example.com" becomes "a***@example.com".
+func RedactEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return redacted
+	}
+	return local[:1] + "***@" + domain
+}
+
+// redactAttr is the ReplaceAttr hook of every handler created by Setup. It
+// applies to the message as well as to attributes.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case secretKeys[key]:
+		return slog.String(a.Key, redacted)
+	case emailKeys[key] && a.Value.Kind() == slog.KindString:
+		return slog.String(a.Key, RedactEmail(a.Value.String()))
+	}
+
+	switch v := a.Value.Resolve(); v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -1,38 +1,153 @@
 package main
 
 import (
-	"net/http"
-	"fmt"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
 	weatherAPI "github.com/ilyaytrewq/WeatherServiceAPI/internal"
+	"github.com/ilyaytrewq/WeatherServiceAPI/logging"
 )
 
+// shutdownTimeout bounds draining requests, finishing the ingestion batch and
+// closing connections after SIGTERM.
+var shutdownTimeout time.Duration
+
+// opened are the backends connected so far, closed by abort.
+var opened []io.Closer
+
 func main() {
+	var cfg config.API
+	if err := config.Load(&cfg, "weather_service", os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(2)
+	}
+	shutdownTimeout = cfg.HTTP.ShutdownTimeout
 
-	if err := weatherAPI.InitClickhouse(); err != nil {
-		fmt.Printf("Failed to initialize ClickHouse: %v\n", err)
-		return
-	} else {
-		fmt.Printf("Connected to ClickHouse successfully: %v", weatherAPI.ClickhouseConn) 
+	if err := logging.Setup(os.Stderr, cfg.Logging.Format, cfg.Logging.Level); err != nil {
+		slog.Error("Failed to configure logging", "err", err)
+		os.Exit(1)
 	}
+	slog.Info("Configuration loaded", "config", config.LogValue(&cfg))
 
-	if err := weatherAPI.InitPostgres(); err != nil {
-		fmt.Printf("Failed to initialize Postgres: %v\n", err)
-		return
-	} else {
-		fmt.Printf( "Connected to Postgres successfully: %v", weatherAPI.DB)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go logging.WatchSignals(ctx)
+
+	if err := weatherAPI.InitTracing(cfg.Tracing); err != nil {
+		slog.Error("Failed to initialize tracing", "err", err)
+		abort()
 	}
 
-	if err := weatherAPI.InitRabbit(); err != nil {
-		fmt.Printf("Failed to initialize RabbitMQ: %v\n", err)
-		return
+	deps := weatherAPI.Deps{
+		Cities:   weatherAPI.NewCityRegistry(),
+		Provider: weatherAPI.NewOpenWeather(cfg.OpenWeather),
+	}
+	if cfg.Storage == "memory" {
+		slog.Warn("Using in-memory storage: users and metrics are lost on exit, emails are only logged")
+		deps.Users = weatherAPI.NewMemoryUserStore()
+		deps.Metrics = weatherAPI.NewMemoryMetricsStore()
+		deps.Publisher = weatherAPI.NewMemoryPublisher()
 	} else {
-		fmt.Printf("Connected to RabbitMQ successfully")
+		connectBackends(cfg, &deps)
+	}
+
+	svc := weatherAPI.NewService(deps, weatherAPI.Options{
+		IngestionInterval: cfg.Ingestion.Interval,
+		OutboxInterval:    cfg.Outbox.Interval,
+		OutboxBatch:       cfg.Outbox.Batch,
+	})
+
+	if err := svc.Start(ctx); err != nil {
+		slog.Error("Failed to start the service", "err", err)
+		abort()
 	}
 
-	http.HandleFunc("/v1/", weatherAPI.Handler)
-	fmt.Println("Starting server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		fmt.Printf("Server failed to start: %v\n", err)
+	go reloadCitiesOnSignal(ctx, svc)
+
+	if err := svc.Serve(ctx, ":"+strconv.Itoa(cfg.HTTP.Port), shutdownTimeout); err != nil {
+		slog.Error("Server stopped with error", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("Server stopped")
+}
+
+// connectBackends connects to ClickHouse, Postgres and RabbitMQ, aborting on
+// the first failure.
+func connectBackends(cfg config.API, deps *weatherAPI.Deps) {
+	metrics, err := weatherAPI.NewClickHouseStore(cfg.ClickHouse)
+	if err != nil {
+		slog.Error("Failed to initialize ClickHouse", "err", err)
+		abort()
+	}
+	opened = append(opened, metrics)
+	deps.Metrics = metrics
+	slog.Info("Connected to ClickHouse")
+
+	users, err := weatherAPI.NewPostgresStore(cfg.Postgres)
+	if err != nil {
+		slog.Error("Failed to initialize Postgres", "err", err)
+		abort()
+	}
+	opened = append(opened, users)
+	deps.Users = users
+	slog.Info("Connected to Postgres")
+
+	publisher, err := weatherAPI.NewRabbitPublisher(cfg.RabbitMQ)
+	if err != nil {
+		slog.Error("Failed to initialize RabbitMQ", "err", err)
+		abort()
+	}
+	opened = append(opened, publisher)
+	deps.Publisher = publisher
+	slog.Info("Connected to RabbitMQ")
+}
+
+// abort releases whatever was opened before a startup failure.
+func abort() {
+	for i := len(opened) - 1; i >= 0; i-- {
+		if err := opened[i].Close(); err != nil {
+			slog.Error("Shutdown error", "err", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := weatherAPI.CloseTracing(ctx); err != nil {
+		slog.Error("Shutdown error", "err", err)
+	}
+	cancel()
+	os.Exit(1)
+}
+
+// reloadCitiesOnSignal reloads the city registry from the metrics store on SIGHUP
+// until ctx is cancelled.
+func reloadCitiesOnSignal(ctx context.Context, svc *weatherAPI.Service) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigc:
+		}
+
+		reloadCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := svc.ReloadCities(reloadCtx); err != nil {
+			slog.Error("Failed to reload cities", "err", err)
+		}
+		cancel()
 	}
-}
\ No newline at end of file
+}
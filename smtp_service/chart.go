@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"time"
+)
+
+// Size of the temperature chart in pixels, and the margin around the plot.
+const (
+	chartWidth  = 600
+	chartHeight = 240
+	chartMargin = 16
+)
+
+// Temperatures outside this range in °C are taken for garbage, and the chart
+// has at most chartMaxGrid horizontal grid lines.
+const (
+	minTemp      = -100
+	maxTemp      = 100
+	chartMaxGrid = 12
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartGrid       = color.RGBA{0xe5, 0xe7, 0xeb, 0xff}
+	chartZero       = color.RGBA{0x9c, 0xa3, 0xaf, 0xff}
+	chartLine       = color.RGBA{0x25, 0x63, 0xeb, 0xff}
+)
+
+// tempPoint is one temperature reading of a digest.
+type tempPoint struct {
+	Time time.Time
+	Temp float64
+}
+
+// parseTempPoints reads the samples of a weather digest, a list of
+// {"time": RFC 3339, "temp": °C} objects as decoded from JSON.
+func parseTempPoints(v interface{}) ([]tempPoint, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("samples: want a non-empty list")
+	}
+	points := make([]tempPoint, 0, len(list))
+	for i, item := range list {
+		sample, _ := item.(map[string]interface{})
+		ts, _ := sample["time"].(string)
+		temp, ok := sample["temp"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("samples[%d]: temp is not a number", i)
+		}
+		if temp < minTemp || temp > maxTemp {
+			return nil, fmt.Errorf("samples[%d]: temp %g °C is out of range", i, temp)
+		}
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return nil, fmt.Errorf("samples[%d]: time: %w", i, err)
+		}
+		points = append(points, tempPoint{Time: t, Temp: temp})
+	}
+	return points, nil
+}
+
+// temperatureChart draws points as a line chart and encodes it as PNG. The
+// x axis is time and the y axis spans the temperature range, with grid lines
+// every 5 °C, or a multiple of 5 if the range is wide, and a darker one at
+// zero. There are no labels: the email lists the values next to the chart.
+// The temperatures must be within minTemp..maxTemp.
+func temperatureChart(points []tempPoint) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.Point{}, draw.Src)
+
+	lo, hi := points[0].Temp, points[0].Temp
+	first, last := points[0].Time, points[0].Time
+	for _, p := range points {
+		lo, hi = math.Min(lo, p.Temp), math.Max(hi, p.Temp)
+		if p.Time.Before(first) {
+			first = p.Time
+		}
+		if p.Time.After(last) {
+			last = p.Time
+		}
+	}
+	lo, hi = math.Floor(lo)-1, math.Ceil(hi)+1
+	span := last.Sub(first)
+
+	plotW, plotH := float64(chartWidth-2*chartMargin), float64(chartHeight-2*chartMargin)
+	x := func(i int, t time.Time) float64 {
+		if span == 0 {
+			return chartMargin + plotW*float64(i)/math.Max(1, float64(len(points)-1))
+		}
+		return chartMargin + plotW*float64(t.Sub(first))/float64(span)
+	}
+	y := func(temp float64) float64 {
+		return chartMargin + plotH*(hi-temp)/(hi-lo)
+	}
+
+	step := 5 * math.Ceil((hi-lo)/5/chartMaxGrid)
+	for g := math.Ceil(lo/step) * step; g <= hi; g += step {
+		c := chartGrid
+		if g == 0 {
+			c = chartZero
+		}
+		yy := int(math.Round(y(g)))
+		for xx := chartMargin; xx < chartWidth-chartMargin; xx++ {
+			img.Set(xx, yy, c)
+		}
+	}
+
+	for i := 1; i < len(points); i++ {
+		drawLine(img, x(i-1, points[i-1].Time), y(points[i-1].Temp), x(i, points[i].Time), y(points[i].Temp), chartLine)
+	}
+	for i, p := range points {
+		drawDot(img, x(i, p.Time), y(p.Temp), 3, chartLine)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("temperatureChart: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLine draws a two pixel wide segment from (x0, y0) to (x1, y1).
+func drawLine(img draw.Image, x0, y0, x1, y1 float64, c color.Color) {
+	steps := math.Max(math.Abs(x1-x0), math.Abs(y1-y0))
+	for s := 0.0; s <= steps; s++ {
+		t := s / math.Max(steps, 1)
+		drawDot(img, x0+(x1-x0)*t, y0+(y1-y0)*t, 1, c)
+	}
+}
+
+// drawDot fills a disc of radius r around (cx, cy).
+func drawDot(img draw.Image, cx, cy float64, r int, c color.Color) {
+	px, py := int(math.Round(cx)), int(math.Round(cy))
+	for dx := -r; dx <= r; dx++ {
+		for dy := -r; dy <= r; dy++ {
+			if dx*dx+dy*dy <= r*r {
+				img.Set(px+dx, py+dy, c)
+			}
+		}
+	}
+}
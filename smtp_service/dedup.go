@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Expired keys are dropped, and the file rewritten without them, at most
+// this often.
+const deliveryLogSweep = 10 * time.Minute
+
+// deliveryLog remembers the keys of delivered emails for ttl. The keys live in
+// memory and are appended to a file, one "<expiry unix> <quoted key>" line
+// each, so that they survive a restart.
+type deliveryLog struct {
+	path string
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu        sync.Mutex
+	f         *os.File
+	lastSweep time.Time
+	delivered map[string]time.Time
+	// sending holds the keys being sent, closed when the send is over.
+	sending map[string]chan struct{}
+}
+
+// openDeliveryLog loads the unexpired keys from path, creating it if needed.
+func openDeliveryLog(path string, ttl time.Duration) (*deliveryLog, error) {
+	l := &deliveryLog{
+		path:      path,
+		ttl:       ttl,
+		now:       time.Now,
+		delivered: make(map[string]time.Time),
+		sending:   make(map[string]chan struct{}),
+	}
+	if err := l.load(); err != nil {
+		return nil, fmt.Errorf("openDeliveryLog: %w", err)
+	}
+	if err := l.compact(); err != nil {
+		return nil, fmt.Errorf("openDeliveryLog: %w", err)
+	}
+	return l, nil
+}
+
+func (l *deliveryLog) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := l.now()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		expiry, quoted, _ := strings.Cut(sc.Text(), " ")
+		unix, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			continue
+		}
+		key, err := strconv.Unquote(quoted)
+		if err != nil {
+			// a line cut short by a crash
+			continue
+		}
+		if until := time.Unix(unix, 0); until.After(now) {
+			l.delivered[key] = until
+		}
+	}
+	return sc.Err()
+}
+
+// sweep drops the expired keys, rewriting the file if there were any. The
+// caller holds l.mu.
+func (l *deliveryLog) sweep() error {
+	now := l.now()
+	if now.Sub(l.lastSweep) < deliveryLogSweep {
+		return nil
+	}
+	l.lastSweep = now
+	expired := false
+	for _, until := range l.delivered {
+		if !until.After(now) {
+			expired = true
+			break
+		}
+	}
+	if !expired {
+		return nil
+	}
+	return l.compact()
+}
+
+// compact rewrites the file with the live keys only. The caller holds l.mu
+// or has l to itself.
+func (l *deliveryLog) compact() error {
+	now := l.now()
+	for key, until := range l.delivered {
+		if !until.After(now) {
+			delete(l.delivered, key)
+		}
+	}
+	l.lastSweep = now
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o750); err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for key, until := range l.delivered {
+		fmt.Fprintf(w, "%d %q\n", until.Unix(), key)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o640)
+	return err
+}
+
+// claim reports whether the email with key was delivered already. Otherwise
+// the caller is to send it and report the outcome to done; a concurrent
+// claim of the same key waits for that. Emails without a key are always
+// sent.
+func (l *deliveryLog) claim(key string) (done func(sent bool) error, duplicate bool) {
+	if key == "" {
+		return func(bool) error { return nil }, false
+	}
+	for {
+		l.mu.Lock()
+		if until, ok := l.delivered[key]; ok && until.After(l.now()) {
+			l.mu.Unlock()
+			return nil, true
+		}
+		wait, ok := l.sending[key]
+		if !ok {
+			wait = make(chan struct{})
+			l.sending[key] = wait
+			l.mu.Unlock()
+			return func(sent bool) error { return l.finish(key, wait, sent) }, false
+		}
+		l.mu.Unlock()
+		<-wait
+	}
+}
+
+// finish ends the send of key, recording it if it was sent. The key stays
+// remembered in memory even if it cannot be written down.
+func (l *deliveryLog) finish(key string, wait chan struct{}, sent bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sending, key)
+	close(wait)
+	if !sent {
+		return nil
+	}
+
+	until := l.now().Add(l.ttl)
+	l.delivered[key] = until
+	if _, err := fmt.Fprintf(l.f, "%d %q\n", until.Unix(), key); err != nil {
+		return fmt.Errorf("deliveryLog: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("deliveryLog: %w", err)
+	}
+	if err := l.sweep(); err != nil {
+		return fmt.Errorf("deliveryLog: compact: %w", err)
+	}
+	return nil
+}
+
+func (l *deliveryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
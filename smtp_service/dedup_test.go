@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliveryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delivered.log")
+	l, err := openDeliveryLog(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done, duplicate := l.claim("k1")
+	if duplicate {
+		t.Fatal("fresh key reported as duplicate")
+	}
+	if err := done(false); err != nil {
+		t.Fatal(err)
+	}
+	done, duplicate = l.claim("k1")
+	if duplicate {
+		t.Fatal("key of a failed send reported as duplicate")
+	}
+
+	// a concurrent claim waits for the send in progress
+	claimed := make(chan bool)
+	go func() {
+		_, duplicate := l.claim("k1")
+		claimed <- duplicate
+	}()
+	select {
+	case <-claimed:
+		t.Fatal("claim did not wait for the send in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := done(true); err != nil {
+		t.Fatal(err)
+	}
+	if !<-claimed {
+		t.Error("claim after the send is over: not a duplicate")
+	}
+	if _, duplicate := l.claim(""); duplicate {
+		t.Error("email without a key reported as duplicate")
+	}
+	l.Close()
+
+	// the key survives a restart, and expires after the ttl
+	l, err = openDeliveryLog(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, duplicate := l.claim("k1"); !duplicate {
+		t.Error("delivered key forgotten after reopening")
+	}
+	l.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, duplicate := l.claim("k1"); duplicate {
+		t.Error("expired key reported as duplicate")
+	}
+	l.Close()
+}
+
+func TestDeliveryLogDropsExpiredKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delivered.log")
+	l, err := openDeliveryLog(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 5000; i++ {
+		done, _ := l.claim(fmt.Sprintf("old-%d", i))
+		if err := done(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(time.Hour + deliveryLogSweep)
+	done, _ := l.claim("new")
+	if err := done(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(l.delivered); got != 1 {
+		t.Errorf("%d keys kept in memory, want 1", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("log holds %d lines, want 1", lines)
+	}
+}
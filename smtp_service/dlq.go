@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	"github.com/ilyaytrewq/WeatherServiceAPI/logging"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const dlqUsage = `usage: smtp_service dlq list|replay [-limit n] [flags]
+
+list    print the dead-lettered emails as JSON lines, leaving them queued
+replay  move them back to email_queue with the attempt count reset`
+
+// deadEmail is one line of `dlq list`.
+type deadEmail struct {
+	Key       string    `json:"key,omitempty"`
+	To        string    `json:"to"`
+	Type      string    `json:"type"`
+	Locale    string    `json:"locale,omitempty"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	Published time.Time `json:"published"`
+}
+
+// runDLQ runs `smtp_service dlq` with args, the arguments after "dlq", and
+// returns the exit code.
+func runDLQ(args []string) int {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "replay") {
+		fmt.Fprintln(os.Stderr, dlqUsage)
+		return 2
+	}
+	var cfg config.DeadLetters
+	if err := config.Load(&cfg, "smtp_service dlq "+args[0], args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := logging.Setup(os.Stderr, cfg.Logging.Format, cfg.Logging.Level); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	conn, err := amqp.Dial(cfg.RabbitMQ.URL)
+	if err != nil {
+		slog.Error("dlq: dial", "err", err)
+		return 1
+	}
+	defer conn.Close()
+
+	if args[0] == "list" {
+		err = listDeadLetters(conn, cfg.Limit, os.Stdout)
+	} else {
+		err = replayDeadLetters(conn, cfg.Limit)
+	}
+	if err != nil {
+		slog.Error("dlq: "+args[0], "err", err)
+		return 1
+	}
+	return 0
+}
+
+// listDeadLetters writes up to limit dead-lettered emails to w. The messages
+// are only fetched, not acked, so they return to the queue when the channel
+// closes.
+func listDeadLetters(conn *amqp.Connection, limit int, w io.Writer) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	defer ch.Close()
+
+	enc := json.NewEncoder(w)
+	for n := 0; limit == 0 || n < limit; n++ {
+		d, ok, err := ch.Get(deadQueue, false)
+		if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+
+		// An undecodable task is listed with empty fields; its last error
+		// says why.
+		var t EmailTask
+		json.Unmarshal(d.Body, &t)
+		lastError, _ := d.Headers[lastErrorHeader].(string)
+		if err := enc.Encode(deadEmail{
+			Key:       t.Key,
+			To:        t.To,
+			Type:      t.Type,
+			Locale:    t.Locale,
+			Attempts:  attempts(d.Headers),
+			LastError: lastError,
+			Published: d.Timestamp,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayDeadLetters moves up to limit dead-lettered emails back to
+// email_queue, giving each of them a fresh set of attempts. It replays at
+// most the emails in the queue when it starts: one that fails again at once,
+// such as a task that cannot be rendered, returns to the queue behind them.
+func replayDeadLetters(conn *amqp.Connection, limit int) error {
+	r, err := newRetrier(conn, config.Retry{})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("channel: %w", err)
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(deadQueue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", deadQueue, err)
+	}
+	if limit == 0 || limit > q.Messages {
+		limit = q.Messages
+	}
+
+	replayed := 0
+	defer func() { slog.Info("dlq: replayed", "count", replayed) }()
+	for ; replayed < limit; replayed++ {
+		d, ok, err := ch.Get(deadQueue, false)
+		if err != nil {
+			return fmt.Errorf("get: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+
+		headers := copyHeaders(d.Headers)
+		delete(headers, attemptsHeader)
+		delete(headers, lastErrorHeader)
+		ctx, cancel := context.WithTimeout(context.Background(), retryPublishTimeout)
+		err = r.move(ctx, d, emailExchange, emailRouting, headers)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// checkResult and healthResp mirror the Check and Health schemas of the API.
+type checkResult struct {
+	Status    string `json:"status"`
+	Critical  bool   `json:"critical"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+type healthResp struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// A check is critical if the worker cannot process emails while it fails,
+// and fatal if the worker cannot recover from the failure without a restart.
+type healthCheck struct {
+	name     string
+	critical bool
+	fatal    bool
+	run      func(ctx context.Context) error
+}
+
+// healthServer exposes /healthz, /readyz and /metrics for the worker.
+type healthServer struct {
+	checks       []healthCheck
+	shuttingDown atomic.Bool
+	srv          *http.Server
+}
+
+func newHealthServer(addr string, conn *amqp.Connection, ch *amqp.Channel, consuming *atomic.Bool, transport Transport) *healthServer {
+	h := &healthServer{
+		checks: []healthCheck{
+			{name: "rabbitmq", critical: true, fatal: true, run: func(ctx context.Context) error {
+				switch {
+				case conn.IsClosed():
+					return errors.New("connection closed")
+				case ch.IsClosed():
+					return errors.New("channel closed")
+				}
+				return nil
+			}},
+			consumerCheck(consuming),
+			{name: "transport", critical: false, run: transport.Ping},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/readyz", h.serveReadyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	h.srv = &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	return h
+}
+
+// consumerCheck fails once the workers have stopped consuming.
+func consumerCheck(consuming *atomic.Bool) healthCheck {
+	return healthCheck{name: "consumer", critical: true, fatal: true, run: func(ctx context.Context) error {
+		if !consuming.Load() {
+			return errors.New("delivery channel closed")
+		}
+		return nil
+	}}
+}
+
+func (h *healthServer) start() {
+	go func() {
+		slog.Info("health: listening", "addr", h.srv.Addr)
+		if err := h.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("health: server error", "err", err)
+		}
+	}()
+}
+
+func (h *healthServer) shutdown(ctx context.Context) error {
+	h.shuttingDown.Store(true)
+	if err := h.srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("health: shutdown: %w", err)
+	}
+	return nil
+}
+
+// run runs every check. dead reports whether a fatal one failed.
+func (h *healthServer) run(ctx context.Context) (resp healthResp, dead bool) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	results := make([]checkResult, len(h.checks))
+	var wg sync.WaitGroup
+	for i, hc := range h.checks {
+		wg.Add(1)
+		go func(i int, hc healthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := hc.run(ctx)
+			res := checkResult{Status: "ok", Critical: hc.critical, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				res.Status = "fail"
+				res.Error = err.Error()
+			}
+			results[i] = res
+		}(i, hc)
+	}
+	wg.Wait()
+
+	resp = healthResp{Status: "ok", Checks: make(map[string]checkResult, len(results))}
+	for i, res := range results {
+		resp.Checks[h.checks[i].name] = res
+		if res.Status == "ok" {
+			continue
+		}
+		dead = dead || h.checks[i].fatal
+		if res.Critical {
+			resp.Status = "fail"
+		} else if resp.Status == "ok" {
+			resp.Status = "degraded"
+		}
+	}
+	return resp, dead
+}
+
+// serveHealthz fails only when a fatal check does: the worker does not
+// reconnect to RabbitMQ, so a lost connection or consumer needs a restart.
+// A broken SMTP server is not fixed by restarting the worker.
+func (h *healthServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	resp, dead := h.run(r.Context())
+	status := http.StatusOK
+	if dead {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+func (h *healthServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	resp, _ := h.run(r.Context())
+	if h.shuttingDown.Load() {
+		resp.Status = "fail"
+		resp.Checks["lifecycle"] = checkResult{Status: "fail", Critical: true, Error: "shutting down"}
+	}
+	status := http.StatusOK
+	if resp.Status == "fail" {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, resp)
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp healthResp) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("health: encode error", "err", err)
+	}
+}
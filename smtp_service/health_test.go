@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthzFailsWhenConsumerIsDead(t *testing.T) {
+	var consuming atomic.Bool
+	consuming.Store(true)
+	h := &healthServer{checks: []healthCheck{
+		consumerCheck(&consuming),
+		{name: "transport", run: func(ctx context.Context) error { return errors.New("smtp down") }},
+	}}
+
+	healthz := func() int {
+		rec := httptest.NewRecorder()
+		h.serveHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+
+	if got := healthz(); got != http.StatusOK {
+		t.Errorf("consuming with the transport down: status %d, want 200", got)
+	}
+	consuming.Store(false)
+	if got := healthz(); got != http.StatusServiceUnavailable {
+		t.Errorf("consumer stopped: status %d, want 503", got)
+	}
+}
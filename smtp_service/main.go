@@ -3,139 +3,301 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	"github.com/ilyaytrewq/WeatherServiceAPI/logging"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/trace"
 	gomail "gopkg.in/gomail.v2"
 )
 
+// EmailTask is the message the API publishes; see templates.go for how it
+// becomes an email.
 type EmailTask struct {
-	To      string                 `json:"to"`
-	Subject string                 `json:"subject"`
-	Body    string                 `json:"body"`
-	Type    string                 `json:"type,omitempty"`
-	Meta    map[string]interface{} `json:"meta,omitempty"`
+	Key    string                 `json:"key,omitempty"`
+	To     string                 `json:"to"`
+	Type   string                 `json:"type"`
+	Locale string                 `json:"locale,omitempty"`
+	Meta   map[string]interface{} `json:"meta,omitempty"`
 }
 
+// consumerTag names the worker's subscription to emailQueue, so that shutdown
+// can cancel it.
+const consumerTag = "smtp_service"
+
 func main() {
-	rabbitURL := os.Getenv("RABBITMQ_URL")
-	if rabbitURL == "" {
-		log.Fatal("RABBITMQ_URL not set")
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		os.Exit(runDLQ(os.Args[2:]))
+	}
+
+	var cfg config.Worker
+	if err := config.Load(&cfg, "smtp_service", os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fatal("invalid configuration", err)
+	}
+
+	if err := logging.Setup(os.Stderr, cfg.Logging.Format, cfg.Logging.Level); err != nil {
+		fatal("logging setup failed", err)
+	}
+	go logging.WatchSignals(context.Background())
+	slog.Info("configuration loaded", "config", config.LogValue(&cfg))
+
+	// Registered first, so it runs after every other deferred close.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	shutdownTracing, err := initTracing(cfg.Tracing)
+	if err != nil {
+		fatal("tracing setup failed", err)
 	}
 
 	// Подключаемся к RabbitMQ с ретраями
 	var conn *amqp.Connection
-	var err error
 	for i := 0; i < 10; i++ {
-		conn, err = amqp.Dial(rabbitURL)
+		conn, err = amqp.Dial(cfg.RabbitMQ.URL)
 		if err == nil {
 			break
 		}
-		log.Printf("RabbitMQ not ready, retry in 2s... (%d/10)", i+1)
+		slog.Warn("RabbitMQ not ready, retry in 2s", "attempt", i+1, "of", 10, "err", err)
 		time.Sleep(2 * time.Second)
 	}
 	if conn == nil {
-		log.Fatalf("could not connect to rabbit after retries: %v", err)
+		fatal("could not connect to rabbit after retries", err)
 	}
 	defer conn.Close()
 
 	ch, err := conn.Channel()
 	if err != nil {
-		log.Fatalf("chan: %v", err)
+		fatal("open channel", err)
 	}
 	defer ch.Close()
 
-	queueName := "email_queue"
+	templates, err := embeddedTemplates()
+	if err != nil {
+		fatal("load templates", err)
+	}
+
+	if err := declareTopology(ch, cfg.Retry); err != nil {
+		fatal("declare queues", err)
+	}
+	retries, err := newRetrier(conn, cfg.Retry)
+	if err != nil {
+		fatal("open retry channel", err)
+	}
+	defer retries.Close()
 
-	_, err = ch.QueueDeclare(
-		queueName,
-		true,  // durable
-		false, // auto-delete
-		false, // exclusive
-		false, // no-wait
-		nil,   // args
-	)
+	deliveries, err := openDeliveryLog(cfg.Dedup.File, cfg.Dedup.TTL)
 	if err != nil {
-		log.Fatalf("declare queue: %v", err)
+		fatal("open delivery log", err)
 	}
+	defer deliveries.Close()
 
-	if err := ch.Qos(5, 0, false); err != nil {
-		log.Fatalf("qos: %v", err)
+	if err := ch.Qos(cfg.Prefetch, 0, false); err != nil {
+		fatal("qos", err)
 	}
 
-	msgs, err := ch.Consume(queueName, "", false, false, false, false, nil)
+	msgs, err := ch.Consume(emailQueue, consumerTag, false, false, false, false, nil)
 	if err != nil {
-		log.Fatalf("consume: %v", err)
+		fatal("consume", err)
 	}
 
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	mailCfg := cfg.SMTP
+	transport, err := newTransport(cfg)
 	if err != nil {
-		log.Fatalf("Invalid SMTP_PORT: %v", err)
+		fatal("mail transport", err)
 	}
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASSWORD")
-	fromAddr := os.Getenv("SMTP_FROM")
+	defer transport.Close()
+	slog.Info("mail transport ready", "transport", cfg.Transport)
+
+	var consuming atomic.Bool
+	consuming.Store(true)
+	health := newHealthServer(cfg.HealthAddr, conn, ch, &consuming, transport)
+	health.start()
 
-	workerCount := 3
-	for i := 0; i < workerCount; i++ {
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		workers.Add(1)
 		go func(id int) {
-			log.Printf("worker %d started", id)
+			defer workers.Done()
+			logger := slog.With("worker", id)
+			logger.Info("worker started")
 			for d := range msgs {
+				spanCtx, span := startDeliverySpan(d)
 				var t EmailTask
 				if err := json.Unmarshal(d.Body, &t); err != nil {
-					log.Printf("worker %d: bad message json: %v", id, err)
+					logger.ErrorContext(spanCtx, "bad message json", "err", err)
+					emailsFailed.Inc()
+					endSpan(span, err)
+					deadLetter(spanCtx, logger, retries, d, err)
+					continue
+				}
+				msg, err := templates.render(t)
+				if err != nil {
+					logger.ErrorContext(spanCtx, "cannot render email", "to", t.To, "type", t.Type, "err", err)
+					emailsFailed.Inc()
+					endSpan(span, err)
+					deadLetter(spanCtx, logger, retries, d, err)
+					continue
+				}
+				done, duplicate := deliveries.claim(t.Key)
+				if duplicate {
+					emailsDuplicate.Inc()
+					endSpan(span, nil)
 					d.Ack(false)
+					logger.InfoContext(spanCtx, "duplicate email skipped", "to", t.To, "type", t.Type, "key", t.Key)
 					continue
 				}
-				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-				err := sendMail(ctx, smtpHost, smtpPort, smtpUser, smtpPass, fromAddr, t)
+				ctx, cancel := context.WithTimeout(spanCtx, mailCfg.SendTimeout)
+				start := time.Now()
+				err = sendMail(ctx, transport, mailCfg.From, msg)
 				cancel()
+				endSpan(span, err)
+				if err := done(err == nil); err != nil {
+					logger.ErrorContext(spanCtx, "could not record delivery", "key", t.Key, "err", err)
+				}
 				if err != nil {
-					log.Printf("worker %d: send mail failed for %s: %v", id, t.To, err)
-					d.Nack(false, true) // повторим сообщение
+					smtpDuration.WithLabelValues("error").Observe(time.Since(start).Seconds())
+					if errors.Is(err, errThrottled) {
+						logger.InfoContext(spanCtx, "send throttled, postponed", "to", t.To, "type", t.Type, "err", err)
+					} else {
+						logger.WarnContext(spanCtx, "send mail failed", "to", t.To, "type", t.Type, "attempt", attempts(d.Headers)+1, "err", err)
+					}
+					retry(spanCtx, logger, retries, d, err)
 					continue
 				}
+				smtpDuration.WithLabelValues("ok").Observe(time.Since(start).Seconds())
+				emailsSent.Inc()
 				d.Ack(false)
-				log.Printf("worker %d: email sent to %s", id, t.To)
+				logger.InfoContext(spanCtx, "email sent", "to", t.To, "type", t.Type)
 			}
 		}(i)
 	}
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		consuming.Store(false)
+		slog.Info("all workers stopped")
+		close(stopped)
+	}()
 
-	// ждём сигнала для graceful shutdown
+	// ждём сигнала для graceful shutdown. The worker does not reconnect: if
+	// the broker closes the channel, every worker stops and the process exits
+	// with an error so that it is restarted.
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-	s := <-sigc
-	log.Printf("Shutting down, signal: %v", s)
+	select {
+	case s := <-sigc:
+		slog.Info("shutting down", "signal", s.String())
+	case <-stopped:
+		slog.Error("consumer stopped, exiting to be restarted")
+		exitCode = 1
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown)
+	if err := health.shutdown(shutdownCtx); err != nil {
+		slog.Error("health shutdown failed", "err", err)
+	}
+	// Stop taking new emails and let the workers finish theirs, so that
+	// their sends are acked and recorded before the delivery log and the
+	// transport close.
+	if exitCode == 0 {
+		if err := ch.Cancel(consumerTag, false); err != nil {
+			slog.Error("cancel consumer failed", "err", err)
+		}
+	}
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		slog.Warn("workers did not stop in time, exiting anyway")
+	}
 	ch.Close()
 	conn.Close()
-	time.Sleep(500 * time.Millisecond)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("tracing shutdown failed", "err", err)
+	}
+	cancel()
 }
 
-func sendMail(ctx context.Context, host string, port int, user, pass, from string, t EmailTask) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", from)
-	m.SetHeader("To", t.To)
-	m.SetHeader("Subject", t.Subject)
-	m.SetBody("text/html", t.Body)
+// retry hands a failed delivery to the retrier. If the retry queue cannot
+// take it, the message is requeued in place rather than lost.
+func retry(ctx context.Context, logger *slog.Logger, retries *retrier, d amqp.Delivery, sendErr error) {
+	ctx, cancel := context.WithTimeout(ctx, retryPublishTimeout)
+	defer cancel()
+	dead, err := retries.fail(ctx, d, sendErr)
+	switch {
+	case err != nil:
+		logger.ErrorContext(ctx, "could not schedule retry, requeueing", "err", err)
+		d.Nack(false, true)
+	case dead:
+		emailsDeadLettered.Inc()
+		logger.ErrorContext(ctx, "attempts exhausted, moved to dead-letter queue", "attempts", attempts(d.Headers)+1)
+	default:
+		emailsRequeued.Inc()
+	}
+}
 
-	d := gomail.NewDialer(host, port, user, pass)
+// deadLetter moves a delivery that can never be sent to the dead-letter
+// queue.
+func deadLetter(ctx context.Context, logger *slog.Logger, retries *retrier, d amqp.Delivery, cause error) {
+	ctx, cancel := context.WithTimeout(ctx, retryPublishTimeout)
+	defer cancel()
+	if err := retries.deadLetter(ctx, d, attempts(d.Headers), cause); err != nil {
+		logger.ErrorContext(ctx, "could not dead-letter, requeueing", "err", err)
+		d.Nack(false, true)
+	}
+}
 
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- d.DialAndSend(m)
-	}()
+// fatal logs msg and exits; err may be nil.
+func fatal(msg string, err error) {
+	if err != nil {
+		slog.Error(msg, "err", err)
+	} else {
+		slog.Error(msg)
+	}
+	os.Exit(1)
+}
 
-	select {
-	case <-ctx.Done():
-		return fmt.Errorf("send timeout")
-	case err := <-errCh:
-		return err
+// sendMail composes e and hands it to transport.
+func sendMail(ctx context.Context, transport Transport, from string, e email) (err error) {
+	ctx, span := tracer.Start(ctx, "mail send", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	m := gomail.NewMessage()
+	if from != "" {
+		m.SetHeader("From", from)
 	}
+	m.SetHeader("To", e.To)
+	m.SetHeader("Subject", e.Subject)
+	m.SetBody("text/plain", e.Text)
+	m.AddAlternative("text/html", e.HTML)
+	names := make([]string, 0, len(e.Inline))
+	for name := range e.Inline {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		data := e.Inline[name]
+		m.Embed(name, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}))
+	}
+
+	return transport.Send(ctx, from, e.To, m)
 }
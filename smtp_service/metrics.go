@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	emailsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_emails_sent_total",
+		Help: "Emails accepted by the SMTP server.",
+	})
+
+	emailsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_emails_failed_total",
+		Help: "Email tasks dead-lettered because they could not be decoded or rendered.",
+	})
+
+	emailsRequeued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_emails_requeued_total",
+		Help: "Email tasks scheduled for another attempt after a failed send.",
+	})
+
+	emailsDeadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_emails_dead_lettered_total",
+		Help: "Email tasks moved to the dead-letter queue after their last attempt.",
+	})
+
+	emailsDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_emails_duplicate_total",
+		Help: "Email tasks skipped because an email with the same key was already delivered.",
+	})
+
+	smtpThrottled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_throttled_total",
+		Help: "Sends delayed by the per-domain rate limit.",
+	})
+
+	smtpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "smtp_send_duration_seconds",
+		Help:    "Time spent delivering one email to the SMTP server, by outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"outcome"})
+)
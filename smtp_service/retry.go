@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// A failed email is not requeued in place. The worker republishes it to a
+// retry queue whose TTL is the backoff for that attempt; when the TTL runs
+// out RabbitMQ dead-letters it back to email_exchange. After the last attempt
+// it goes to the dead-letter queue instead, where `smtp_service dlq` can
+// list and replay it.
+const (
+	emailExchange = "email_exchange"
+	emailQueue    = "email_queue"
+	emailRouting  = "send_email"
+
+	deadExchange = "email_dlx"
+	deadQueue    = "email_dead"
+
+	// attemptsHeader counts the failed sends of a message.
+	attemptsHeader = "x-attempts"
+	// lastErrorHeader holds the error of the last failed send in the DLQ.
+	lastErrorHeader = "x-last-error"
+
+	// retryPublishTimeout bounds moving one message to another queue.
+	retryPublishTimeout = 10 * time.Second
+)
+
+// retryDelay is the backoff after the attempt-th failure.
+func retryDelay(cfg config.Retry, attempt int) time.Duration {
+	return cfg.Backoff << (attempt - 1)
+}
+
+// retryQueue names the queue holding messages for delay. The delay is part
+// of the name because RabbitMQ refuses to redeclare a queue with another TTL.
+func retryQueue(delay time.Duration) string {
+	return "email_retry_" + delay.String()
+}
+
+// declareTopology declares the email queue, one retry queue per backoff step
+// and the dead-letter queue.
+func declareTopology(ch *amqp.Channel, cfg config.Retry) error {
+	if err := ch.ExchangeDeclare(emailExchange, "direct", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declare %s: %w", emailExchange, err)
+	}
+	if _, err := ch.QueueDeclare(emailQueue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declare %s: %w", emailQueue, err)
+	}
+	if err := ch.QueueBind(emailQueue, emailRouting, emailExchange, false, nil); err != nil {
+		return fmt.Errorf("bind %s: %w", emailQueue, err)
+	}
+
+	for attempt := 1; attempt < cfg.MaxAttempts; attempt++ {
+		delay := retryDelay(cfg, attempt)
+		_, err := ch.QueueDeclare(retryQueue(delay), true, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    emailExchange,
+			"x-dead-letter-routing-key": emailRouting,
+		})
+		if err != nil {
+			return fmt.Errorf("declare %s: %w", retryQueue(delay), err)
+		}
+	}
+
+	if err := ch.ExchangeDeclare(deadExchange, "direct", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declare %s: %w", deadExchange, err)
+	}
+	if _, err := ch.QueueDeclare(deadQueue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declare %s: %w", deadQueue, err)
+	}
+	if err := ch.QueueBind(deadQueue, emailRouting, deadExchange, false, nil); err != nil {
+		return fmt.Errorf("bind %s: %w", deadQueue, err)
+	}
+	return nil
+}
+
+// attempts returns how many times the message has failed so far.
+func attempts(headers amqp.Table) int {
+	switch n := headers[attemptsHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// retrier moves failed messages to the retry or dead-letter queues. It
+// publishes on its own channel in confirm mode, shared by all workers.
+type retrier struct {
+	cfg config.Retry
+
+	mu sync.Mutex
+	ch *amqp.Channel
+}
+
+func newRetrier(conn *amqp.Connection, cfg config.Retry) (*retrier, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("newRetrier: channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("newRetrier: confirm mode: %w", err)
+	}
+	return &retrier{cfg: cfg, ch: ch}, nil
+}
+
+// fail records a failed send of d, caused by sendErr, and acks it once its
+// copy is safely in the retry or dead-letter queue. It reports whether the
+// message was dead-lettered. On error d is left unacknowledged.
+func (r *retrier) fail(ctx context.Context, d amqp.Delivery, sendErr error) (dead bool, err error) {
+	exchange, key, headers, dead := nextHop(r.cfg, d.Headers, sendErr)
+	return dead, r.move(ctx, d, exchange, key, headers)
+}
+
+// nextHop decides where a message with headers goes after a send failed with
+// sendErr: to the retry queue for its attempt, or to the dead-letter queue
+// after the last one. A throttled send never reached the server and is not
+// counted as an attempt; the message waits in the first retry queue.
+func nextHop(cfg config.Retry, headers amqp.Table, sendErr error) (exchange, key string, out amqp.Table, dead bool) {
+	out = copyHeaders(headers)
+	if errors.Is(sendErr, errThrottled) {
+		return "", retryQueue(retryDelay(cfg, 1)), out, false
+	}
+	attempt := attempts(headers) + 1
+	out[attemptsHeader] = int32(attempt)
+	if attempt >= cfg.MaxAttempts {
+		out[lastErrorHeader] = sendErr.Error()
+		return deadExchange, emailRouting, out, true
+	}
+	return "", retryQueue(retryDelay(cfg, attempt)), out, false
+}
+
+// deadLetter moves d to the dead-letter queue, recording attempt and cause.
+func (r *retrier) deadLetter(ctx context.Context, d amqp.Delivery, attempt int, cause error) error {
+	headers := copyHeaders(d.Headers)
+	headers[attemptsHeader] = int32(attempt)
+	headers[lastErrorHeader] = cause.Error()
+	return r.move(ctx, d, deadExchange, emailRouting, headers)
+}
+
+// move republishes d with headers and acks it.
+func (r *retrier) move(ctx context.Context, d amqp.Delivery, exchange, key string, headers amqp.Table) error {
+	err := r.publish(ctx, exchange, key, amqp.Publishing{
+		ContentType:  d.ContentType,
+		Headers:      headers,
+		Body:         d.Body,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    d.Timestamp,
+		MessageId:    d.MessageId,
+	})
+	if err != nil {
+		return err
+	}
+	return d.Ack(false)
+}
+
+// copyHeaders copies the headers of a delivery without the x-death history
+// RabbitMQ adds on every dead-lettering; attemptsHeader replaces it.
+func copyHeaders(h amqp.Table) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range h {
+		headers[k] = v
+	}
+	delete(headers, "x-death")
+	return headers
+}
+
+// publish sends msg and waits for the broker to confirm it.
+func (r *retrier) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	confirm, err := r.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return fmt.Errorf("publish to %q: %w", key, err)
+	}
+	acked := make(chan bool, 1)
+	go func() { acked <- confirm.Wait() }()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("publish to %q: waiting for confirm: %w", key, ctx.Err())
+	case ok := <-acked:
+		if !ok {
+			return fmt.Errorf("publish to %q: nacked by broker", key)
+		}
+	}
+	return nil
+}
+
+func (r *retrier) Close() error {
+	return r.ch.Close()
+}
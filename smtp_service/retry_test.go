@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestThrottledSendsNeverDeadLetter(t *testing.T) {
+	cfg := config.Retry{MaxAttempts: 3, Backoff: 30 * time.Second}
+
+	// a domain limited to one email a minute, already used up
+	l := newDomainLimiter(1, 1)
+	l.reserve("example.com")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	throttled := l.wait(ctx, "bob@example.com")
+	if !errors.Is(throttled, errThrottled) {
+		t.Fatalf("wait: err = %v, want errThrottled", throttled)
+	}
+
+	headers := amqp.Table{attemptsHeader: int32(cfg.MaxAttempts - 1)}
+	for i := 0; i < 10; i++ {
+		exchange, key, out, dead := nextHop(cfg, headers, throttled)
+		if dead || exchange == deadExchange {
+			t.Fatalf("throttled send %d was dead-lettered", i+1)
+		}
+		if key != retryQueue(cfg.Backoff) {
+			t.Errorf("throttled send %d: queue %q, want %q", i+1, key, retryQueue(cfg.Backoff))
+		}
+		if got := attempts(out); got != cfg.MaxAttempts-1 {
+			t.Fatalf("throttled send %d: attempts %d, want %d", i+1, got, cfg.MaxAttempts-1)
+		}
+		headers = out
+	}
+
+	if _, _, _, dead := nextHop(cfg, headers, errors.New("550 mailbox unavailable")); !dead {
+		t.Error("a real failure on the last attempt was not dead-lettered")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// smtpTransport sends through an SMTP server. Connections stay open and
+// authenticated between messages: there are at most poolSize idle ones, one
+// per worker, so a worker normally reuses the connection it sent its previous
+// email over. Sends to one recipient domain are rate limited.
+type smtpTransport struct {
+	cfg      config.SMTP
+	addr     string
+	idle     chan *smtpConn
+	throttle *domainLimiter
+}
+
+// smtpConn is a client with the connection under it, whose deadline bounds
+// every exchange with the server.
+type smtpConn struct {
+	*smtp.Client
+	conn net.Conn
+}
+
+func newSMTPTransport(cfg config.SMTP, poolSize int) *smtpTransport {
+	return &smtpTransport{
+		cfg:      cfg,
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		idle:     make(chan *smtpConn, poolSize),
+		throttle: newDomainLimiter(cfg.DomainRate, cfg.DomainBurst),
+	}
+}
+
+// Send delivers msg. Cancelling ctx aborts a dial or exchange in progress.
+func (t *smtpTransport) Send(ctx context.Context, from, to string, msg io.WriterTo) (err error) {
+	trace.SpanFromContext(ctx).SetAttributes(semconv.ServerAddress(t.cfg.Host), semconv.ServerPort(t.cfg.Port))
+	if err := t.throttle.wait(ctx, to); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// The connection deadline can fire just before ctx notices its own.
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w (%v)", ctx.Err(), err)
+		}
+	}()
+
+	c, err := t.client(ctx)
+	if err != nil {
+		return err
+	}
+	stop := c.bind(ctx)
+	err = deliver(c.Client, from, to, msg)
+	if !stop() || err != nil {
+		c.Close()
+		return err
+	}
+
+	select {
+	case t.idle <- c:
+	default:
+		c.quit()
+	}
+	return nil
+}
+
+// bind makes the connection fail as soon as ctx is done. The returned stop
+// reports whether the connection is still usable.
+func (c *smtpConn) bind(ctx context.Context) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+	stopAfter := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+	return func() bool {
+		if !stopAfter() {
+			return false
+		}
+		return c.conn.SetDeadline(time.Time{}) == nil
+	}
+}
+
+// quit says goodbye without waiting long for the answer.
+func (c *smtpConn) quit() {
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	c.Quit()
+}
+
+// client returns an idle connection that still answers, or a new one.
+func (t *smtpTransport) client(ctx context.Context) (*smtpConn, error) {
+	for {
+		select {
+		case c := <-t.idle:
+			stop := c.bind(ctx)
+			err := c.Noop()
+			if stop() && err == nil {
+				return c, nil
+			}
+			c.Close()
+		default:
+			return t.dial(ctx)
+		}
+	}
+}
+
+// dial connects, secures the connection as configured and authenticates.
+func (t *smtpTransport) dial(ctx context.Context) (*smtpConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: dial: %w", err)
+	}
+	tlsConfig := &tls.Config{ServerName: t.cfg.Host}
+	if t.cfg.TLS == "tls" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c := &smtpConn{conn: conn}
+	stop := c.bind(ctx)
+
+	if err := t.handshake(c, conn, tlsConfig); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !stop() {
+		c.Close()
+		return nil, fmt.Errorf("smtp: dial: %w", ctx.Err())
+	}
+	return c, nil
+}
+
+// handshake reads the greeting, starts TLS if configured and authenticates.
+func (t *smtpTransport) handshake(c *smtpConn, conn net.Conn, tlsConfig *tls.Config) error {
+	client, err := smtp.NewClient(conn, t.cfg.Host)
+	if err != nil {
+		return fmt.Errorf("smtp: greeting: %w", err)
+	}
+	c.Client = client
+
+	if t.cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp: server does not support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("smtp: starttls: %w", err)
+		}
+	}
+	if t.cfg.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", t.cfg.User, t.cfg.Password, t.cfg.Host)); err != nil {
+			return fmt.Errorf("smtp: auth: %w", err)
+		}
+	}
+	return nil
+}
+
+// deliver sends one message over c.
+func deliver(c *smtp.Client, from, to string, msg io.WriterTo) error {
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("smtp: MAIL FROM: %w", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return fmt.Errorf("smtp: RCPT TO: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that the server accepts TCP connections.
+func (t *smtpTransport) Ping(ctx context.Context) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// Close says goodbye on the idle connections.
+func (t *smtpTransport) Close() error {
+	for {
+		select {
+		case c := <-t.idle:
+			c.quit()
+		default:
+			return nil
+		}
+	}
+}
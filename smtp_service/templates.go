@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Emails are rendered here rather than by the API: a task names its kind in
+// Type and carries the values the templates need in Meta. Each kind has a
+// pair of templates per locale under templates/, <type>.<locale>.txt for the
+// plain text part, which also defines the "subject" template, and
+// <type>.<locale>.html for the HTML part. Images the HTML part shows inline
+// are generated from Meta too and referenced as cid:<name>.
+
+//go:embed templates
+var templateFiles embed.FS
+
+// defaultLocale is used when a task names no locale or one without
+// templates. Every kind must have it.
+const defaultLocale = "en"
+
+// emailKind describes one known value of EmailTask.Type.
+type emailKind struct {
+	// required are the Meta fields the templates use.
+	required []string
+	// inline, if set, builds the images embedded in the HTML part, by name.
+	inline func(meta map[string]interface{}) (map[string][]byte, error)
+}
+
+var emailKinds = map[string]emailKind{
+	"account_locked": {required: []string{"failures", "locked_until"}},
+	"weather_digest": {required: []string{"city", "samples"}, inline: digestChart},
+}
+
+// digestChart draws the temperatures of a weather digest as temperature.png.
+func digestChart(meta map[string]interface{}) (map[string][]byte, error) {
+	points, err := parseTempPoints(meta["samples"])
+	if err != nil {
+		return nil, err
+	}
+	chart, err := temperatureChart(points)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{"temperature.png": chart}, nil
+}
+
+// errInvalidTask marks tasks that can never be rendered; they are
+// dead-lettered instead of retried.
+var errInvalidTask = errors.New("invalid email task")
+
+var templateFuncs = map[string]any{
+	// formatTime formats an RFC 3339 timestamp for people.
+	"formatTime": func(s string) (string, error) {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return "", err
+		}
+		return t.UTC().Format("02 Jan 2006 15:04 MST"), nil
+	},
+}
+
+// email is a rendered email task.
+type email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// Inline holds the images the HTML part refers to, by file name.
+	Inline map[string][]byte
+}
+
+type localizedTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// renderer holds the parsed templates by kind and locale.
+type renderer struct {
+	templates map[string]map[string]localizedTemplates
+}
+
+// loadTemplates parses every template in fsys, which holds the files of the
+// templates directory, and checks that each kind has its default locale.
+func loadTemplates(fsys fs.FS) (*renderer, error) {
+	r := &renderer{templates: make(map[string]map[string]localizedTemplates)}
+
+	names, err := fs.Glob(fsys, "*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("loadTemplates: %w", err)
+	}
+	for _, name := range names {
+		kind, locale, ok := strings.Cut(strings.TrimSuffix(name, ".txt"), ".")
+		if !ok {
+			return nil, fmt.Errorf("loadTemplates: %s: want <type>.<locale>.txt", name)
+		}
+		if _, ok := emailKinds[kind]; !ok {
+			return nil, fmt.Errorf("loadTemplates: %s: unknown email type %q", name, kind)
+		}
+
+		text, err := texttemplate.New(name).Funcs(templateFuncs).Option("missingkey=error").ParseFS(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("loadTemplates: %w", err)
+		}
+		if text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("loadTemplates: %s: no subject template", name)
+		}
+		htmlName := kind + "." + locale + ".html"
+		html, err := htmltemplate.New(htmlName).Funcs(templateFuncs).Option("missingkey=error").ParseFS(fsys, htmlName)
+		if err != nil {
+			return nil, fmt.Errorf("loadTemplates: %w", err)
+		}
+
+		if r.templates[kind] == nil {
+			r.templates[kind] = make(map[string]localizedTemplates)
+		}
+		r.templates[kind][locale] = localizedTemplates{text: text, html: html}
+	}
+
+	for kind := range emailKinds {
+		if _, ok := r.templates[kind][defaultLocale]; !ok {
+			return nil, fmt.Errorf("loadTemplates: %s has no %s templates", kind, defaultLocale)
+		}
+	}
+	return r, nil
+}
+
+// embeddedTemplates loads the templates built into the binary.
+func embeddedTemplates() (*renderer, error) {
+	fsys, err := fs.Sub(templateFiles, "templates")
+	if err != nil {
+		return nil, fmt.Errorf("embeddedTemplates: %w", err)
+	}
+	return loadTemplates(fsys)
+}
+
+// render renders t in its locale, falling back to the base language and then
+// to defaultLocale. Unknown types and missing Meta fields match
+// errInvalidTask.
+func (r *renderer) render(t EmailTask) (email, error) {
+	kind, ok := emailKinds[t.Type]
+	if !ok {
+		return email{}, fmt.Errorf("%w: unknown type %q", errInvalidTask, t.Type)
+	}
+	for _, field := range kind.required {
+		if _, ok := t.Meta[field]; !ok {
+			return email{}, fmt.Errorf("%w: %s: missing meta field %q", errInvalidTask, t.Type, field)
+		}
+	}
+	if t.To == "" {
+		return email{}, fmt.Errorf("%w: no recipient", errInvalidTask)
+	}
+
+	var inline map[string][]byte
+	if kind.inline != nil {
+		var err error
+		if inline, err = kind.inline(t.Meta); err != nil {
+			return email{}, fmt.Errorf("%w: %s: %v", errInvalidTask, t.Type, err)
+		}
+	}
+
+	tmpl := r.localized(t.Type, t.Locale)
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", t.Meta); err != nil {
+		return email{}, fmt.Errorf("%w: %v", errInvalidTask, err)
+	}
+	if err := tmpl.text.Execute(&text, t.Meta); err != nil {
+		return email{}, fmt.Errorf("%w: %v", errInvalidTask, err)
+	}
+	if err := tmpl.html.Execute(&html, t.Meta); err != nil {
+		return email{}, fmt.Errorf("%w: %v", errInvalidTask, err)
+	}
+	return email{
+		To:      t.To,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+		Inline:  inline,
+	}, nil
+}
+
+func (r *renderer) localized(kind, locale string) localizedTemplates {
+	locales := r.templates[kind]
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	base, _, _ := strings.Cut(locale, "-")
+	for _, l := range []string{locale, base} {
+		if tmpl, ok := locales[l]; ok {
+			return tmpl
+		}
+	}
+	return locales[defaultLocale]
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderAccountLocked(t *testing.T) {
+	r, err := embeddedTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]interface{}{"failures": 5, "locked_until": "2024-03-01T12:30:00Z"}
+
+	tests := []struct {
+		locale, subject string
+	}{
+		{"", "Your WeatherService account is temporarily locked"},
+		{"fr", "Your WeatherService account is temporarily locked"},
+		{"ru", "Вход в аккаунт WeatherService временно заблокирован"},
+		{"ru_RU", "Вход в аккаунт WeatherService временно заблокирован"},
+	}
+	for _, tt := range tests {
+		e, err := r.render(EmailTask{To: "a@example.com", Type: "account_locked", Locale: tt.locale, Meta: meta})
+		if err != nil {
+			t.Fatalf("locale %q: %v", tt.locale, err)
+		}
+		if e.Subject != tt.subject {
+			t.Errorf("locale %q: subject %q, want %q", tt.locale, e.Subject, tt.subject)
+		}
+		for _, part := range []string{e.Text, e.HTML} {
+			if !strings.Contains(part, "5") || !strings.Contains(part, "01 Mar 2024 12:30 UTC") {
+				t.Errorf("locale %q: body lacks the meta values:\n%s", tt.locale, part)
+			}
+		}
+	}
+}
+
+func TestRenderRejectsInvalidTasks(t *testing.T) {
+	r, err := embeddedTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, task := range map[string]EmailTask{
+		"unknown type": {To: "a@example.com", Type: "newsletter"},
+		"no type":      {To: "a@example.com"},
+		"missing meta": {To: "a@example.com", Type: "account_locked", Meta: map[string]interface{}{"failures": 5}},
+		"bad time":     {To: "a@example.com", Type: "account_locked", Meta: map[string]interface{}{"failures": 5, "locked_until": "soon"}},
+	} {
+		if _, err := r.render(task); !errors.Is(err, errInvalidTask) {
+			t.Errorf("%s: err = %v, want errInvalidTask", name, err)
+		}
+	}
+}
+
+func TestRenderWeatherDigest(t *testing.T) {
+	r, err := embeddedTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]interface{}{
+		"city": "Moscow",
+		"samples": []interface{}{
+			map[string]interface{}{"time": "2024-03-01T06:00:00Z", "temp": -3.5},
+			map[string]interface{}{"time": "2024-03-01T12:00:00Z", "temp": 2.0},
+			map[string]interface{}{"time": "2024-03-01T18:00:00Z", "temp": 0.5},
+		},
+	}
+
+	e, err := r.render(EmailTask{To: "a@example.com", Type: "weather_digest", Meta: meta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(e.Text, " -3.5 °C") || !strings.Contains(e.HTML, `src="cid:temperature.png"`) {
+		t.Errorf("unexpected digest:\n%s\n%s", e.Text, e.HTML)
+	}
+	img, err := png.Decode(bytes.NewReader(e.Inline["temperature.png"]))
+	if err != nil {
+		t.Fatalf("chart: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != chartWidth || b.Dy() != chartHeight {
+		t.Errorf("chart is %v, want %dx%d", b, chartWidth, chartHeight)
+	}
+
+	for name, sample := range map[string]map[string]interface{}{
+		"sample without temp": {"time": "2024-03-01T06:00:00Z"},
+		"huge temp":           {"time": "2024-03-01T06:00:00Z", "temp": 1e20},
+		"freezing temp":       {"time": "2024-03-01T06:00:00Z", "temp": -1e7},
+	} {
+		meta["samples"] = []interface{}{sample}
+		if _, err := r.render(EmailTask{To: "a@example.com", Type: "weather_digest", Meta: meta}); !errors.Is(err, errInvalidTask) {
+			t.Errorf("%s: err = %v, want errInvalidTask", name, err)
+		}
+	}
+}
+
+func TestTemperatureChartExtremes(t *testing.T) {
+	at := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+	for _, points := range [][]tempPoint{
+		{{at, minTemp}, {at.Add(time.Hour), maxTemp}},
+		{{at, maxTemp}},
+		{{at, 0}, {at, 0}},
+	} {
+		start := time.Now()
+		if _, err := temperatureChart(points); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%v took %s to draw", points, elapsed)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of domains not mailed for this long are forgotten.
+const domainIdleTTL = 10 * time.Minute
+
+// errThrottled marks sends held back by the limiter. They never reached the
+// server, so they are postponed without counting as an attempt.
+var errThrottled = errors.New("throttled")
+
+type domainBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// domainLimiter spaces out sends per recipient domain so that a burst of
+// emails to one provider does not get the sender throttled: each domain has a
+// token bucket of burst tokens refilled at perMinute a minute. A nil
+// *domainLimiter does not limit.
+type domainLimiter struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	burst     float64
+	buckets   map[string]*domainBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// newDomainLimiter returns nil, no limit, if perMinute is not positive.
+func newDomainLimiter(perMinute, burst int) *domainLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &domainLimiter{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    math.Max(1, float64(burst)),
+		buckets:  make(map[string]*domainBucket),
+		now:      time.Now,
+	}
+}
+
+// wait blocks until an email to the domain of to may be sent. It fails at
+// once if ctx would expire first, giving the slot back.
+func (l *domainLimiter) wait(ctx context.Context, to string) error {
+	if l == nil {
+		return nil
+	}
+	domain := recipientDomain(to)
+	delay := l.reserve(domain)
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		l.release(domain)
+		return fmt.Errorf("%w: next send to %s in %s", errThrottled, domain, delay.Round(time.Millisecond))
+	}
+
+	smtpThrottled.Inc()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.release(domain)
+		return fmt.Errorf("%w: %w", errThrottled, ctx.Err())
+	}
+}
+
+// reserve takes a token from the bucket of domain, going into debt if it is
+// empty, and returns how long the caller has to wait for its token.
+func (l *domainLimiter) reserve(domain string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[domain]
+	if !ok {
+		b = &domainBucket{tokens: l.burst, last: now}
+		l.buckets[domain] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+float64(now.Sub(b.last))/float64(l.interval))
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(l.interval))
+}
+
+// release returns a reserved token that was not used.
+func (l *domainLimiter) release(domain string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[domain]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+func (l *domainLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < domainIdleTTL {
+		return
+	}
+	l.lastSweep = now
+	for domain, b := range l.buckets {
+		if now.Sub(b.last) > domainIdleTTL {
+			delete(l.buckets, domain)
+		}
+	}
+}
+
+// recipientDomain returns the lower-cased domain of an email address.
+func recipientDomain(addr string) string {
+	_, domain, _ := strings.Cut(addr, "@")
+	return strings.ToLower(domain)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+)
+
+// Transport delivers composed messages. Implementations are safe for
+// concurrent use.
+type Transport interface {
+	Send(ctx context.Context, from, to string, msg io.WriterTo) error
+	// Ping checks that messages can be delivered, for the health check.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// newTransport returns the transport selected by cfg.Transport.
+func newTransport(cfg config.Worker) (Transport, error) {
+	switch cfg.Transport {
+	case "smtp":
+		return newSMTPTransport(cfg.SMTP, cfg.Workers), nil
+	case "maildir":
+		return newMaildirTransport(cfg.MailDir)
+	case "stdout":
+		return &writerTransport{w: os.Stdout}, nil
+	}
+	return nil, fmt.Errorf("newTransport: unknown transport %q", cfg.Transport)
+}
+
+// writerTransport writes every message to w, each followed by a blank line.
+type writerTransport struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *writerTransport) Send(ctx context.Context, from, to string, msg io.WriterTo) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := msg.WriteTo(t.w); err != nil {
+		return fmt.Errorf("writerTransport: %w", err)
+	}
+	_, err := io.WriteString(t.w, "\r\n\r\n")
+	return err
+}
+
+func (t *writerTransport) Ping(ctx context.Context) error { return nil }
+
+func (t *writerTransport) Close() error { return nil }
+
+// maildirTransport delivers into a Maildir: each message is written under
+// tmp/ and renamed into new/, so that readers never see a partial file.
+type maildirTransport struct {
+	dir      string
+	hostname string
+	seq      atomic.Uint64
+}
+
+func newMaildirTransport(dir string) (*maildirTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o750); err != nil {
+			return nil, fmt.Errorf("newMaildirTransport: %w", err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return &maildirTransport{dir: dir, hostname: hostname}, nil
+}
+
+func (t *maildirTransport) Send(ctx context.Context, from, to string, msg io.WriterTo) error {
+	name := fmt.Sprintf("%d.P%dQ%d.%s", time.Now().UnixNano(), os.Getpid(), t.seq.Add(1), t.hostname)
+	tmp := filepath.Join(t.dir, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return fmt.Errorf("maildirTransport: %w", err)
+	}
+	if _, err := msg.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("maildirTransport: write: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("maildirTransport: write: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(t.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("maildirTransport: %w", err)
+	}
+	return nil
+}
+
+func (t *maildirTransport) Ping(ctx context.Context) error {
+	_, err := os.Stat(filepath.Join(t.dir, "new"))
+	return err
+}
+
+func (t *maildirTransport) Close() error { return nil }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/config"
+)
+
+var lockedTask = EmailTask{
+	To:   "alice@example.com",
+	Type: "account_locked",
+	Meta: map[string]interface{}{"failures": 5, "locked_until": "2024-03-01T12:30:00Z"},
+}
+
+// renderTask renders task with the embedded templates.
+func renderTask(t *testing.T, task EmailTask) email {
+	t.Helper()
+	r, err := embeddedTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := r.render(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestMaildirTransport(t *testing.T) {
+	dir := t.TempDir()
+	transport, err := newMaildirTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendMail(context.Background(), transport, "weather@example.com", renderTask(t, lockedTask)); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("new/ holds %d files (err %v), want 1", len(files), err)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp/ holds %d files, want 0", len(tmp))
+	}
+
+	f, err := os.Open(filepath.Join(dir, "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("To"); got != lockedTask.To {
+		t.Errorf("To = %q, want %q", got, lockedTask.To)
+	}
+	if got := msg.Header.Get("Subject"); got != "Your WeatherService account is temporarily locked" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := msg.Header.Get("Content-Type"); !strings.HasPrefix(got, "multipart/alternative") {
+		t.Errorf("Content-Type = %q, want multipart/alternative", got)
+	}
+}
+
+// fakeSMTP is a minimal SMTP server without TLS or authentication that
+// records the messages it accepts. While stalled it never answers the end of
+// DATA.
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	conns    int
+	messages []string
+	stalled  bool
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) config() config.SMTP {
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return config.SMTP{Host: host, Port: p, TLS: "none", From: "weather@example.com", SendTimeout: 5 * time.Second}
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250 fake")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			stalled := s.stalled
+			if !stalled {
+				s.messages = append(s.messages, data.String())
+			}
+			s.mu.Unlock()
+			if stalled {
+				io.Copy(io.Discard, r)
+				return
+			}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTP) stats() (conns int, messages []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, append([]string(nil), s.messages...)
+}
+
+func TestSMTPTransportReusesConnections(t *testing.T) {
+	server := newFakeSMTP(t)
+	cfg := server.config()
+	transport := newSMTPTransport(cfg, 1)
+	defer transport.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := sendMail(context.Background(), transport, cfg.From, renderTask(t, lockedTask)); err != nil {
+			t.Fatalf("send %d: %v", i+1, err)
+		}
+	}
+
+	conns, messages := server.stats()
+	if len(messages) != 3 {
+		t.Fatalf("server got %d messages, want 3", len(messages))
+	}
+	if conns != 1 {
+		t.Errorf("server saw %d connections, want 1", conns)
+	}
+	if !strings.Contains(messages[0], "To: "+lockedTask.To) {
+		t.Errorf("message lacks the To header:\n%s", messages[0])
+	}
+}
+
+func TestSMTPSendTimeoutAbortsExchange(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.stalled = true
+	cfg := server.config()
+	transport := newSMTPTransport(cfg, 1)
+	defer transport.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := sendMail(ctx, transport, cfg.From, renderTask(t, lockedTask))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("send returned after %s, want about 200ms", elapsed)
+	}
+	if len(transport.idle) != 0 {
+		t.Error("timed out connection was kept for reuse")
+	}
+}
+
+func TestDomainLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newDomainLimiter(60, 2)
+	l.now = func() time.Time { return now }
+
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		if got := l.reserve("example.com"); got != want {
+			t.Errorf("reserve %d: wait %s, want %s", i+1, got, want)
+		}
+	}
+	if got := l.reserve("example.org"); got != 0 {
+		t.Errorf("other domain: wait %s, want 0", got)
+	}
+
+	now = now.Add(3 * time.Second)
+	if got := l.reserve("example.com"); got != 0 {
+		t.Errorf("after refill: wait %s, want 0", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, "bob@EXAMPLE.com"); err == nil {
+		t.Error("wait beyond the deadline succeeded")
+	}
+	if got := recipientDomain("bob@EXAMPLE.com"); got != "example.com" {
+		t.Errorf("recipientDomain = %q", got)
+	}
+}